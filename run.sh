@@ -3,4 +3,4 @@
 # set environment
 export NATS_SERVER=${NATS_SERVER:-nats:4222}
 
-/nats-sniffer -nats $NATS_SERVER
+exec /nats-sniffer -nats $NATS_SERVER
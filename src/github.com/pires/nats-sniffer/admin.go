@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pires/nats-sniffer/sniffer"
+	"github.com/satori/go.uuid"
+)
+
+var ERR_SESSION_KILLED = errors.New("Disconnected by an administrator.")
+
+// adminHandler serves the admin API to requests bearing token, e.g.
+// Authorization: Bearer <token>.
+func adminHandler(b *Broker, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/sessions", b.ServeSessions)
+	mux.HandleFunc("/admin/sessions/", b.ServeSessions)
+	mux.HandleFunc("/admin/subjects", b.ServeSubjects)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			unauthorized(w)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// authorized tells whether a request bears token. Without a token, none
+// does.
+func authorized(r *http.Request, token string) bool {
+	header := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, "Bearer ")), []byte(token)) == 1
+}
+
+// unauthorized answers requests lacking the admin token.
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	http.Error(w, "Unauthorized.", http.StatusUnauthorized)
+}
+
+// session is an HTTP client sniffing, over a stream or a WebSocket, as
+// shown to administrators. Captures aren't sessions: they're listed and
+// stopped at /captures.
+type session struct {
+	id         string
+	remoteAddr string
+	userAgent  string
+	start      time.Time
+	// subjects and stats tell what the client sniffs, which may change
+	// over a WebSocket
+	subjects func() []string
+	stats    func() sniffer.ClientStats
+	killed   chan struct{}
+	killOnce sync.Once
+}
+
+// sessionBody describes a session.
+type sessionBody struct {
+	ID         string    `json:"id"`
+	Subjects   []string  `json:"subjects"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent"`
+	Start      time.Time `json:"start"`
+	Delivered  uint64    `json:"delivered"`
+	Dropped    uint64    `json:"dropped"`
+}
+
+// kill asks the session to disconnect its client.
+func (s *session) kill() {
+	s.killOnce.Do(func() { close(s.killed) })
+}
+
+func (s *session) describe() *sessionBody {
+	stats := s.stats()
+	return &sessionBody{
+		ID:         s.id,
+		Subjects:   s.subjects(),
+		RemoteAddr: s.remoteAddr,
+		UserAgent:  s.userAgent,
+		Start:      s.start,
+		Delivered:  stats.Delivered,
+		Dropped:    stats.Dropped,
+	}
+}
+
+// sessionRegistry keeps track of the sessions of a broker.
+type sessionRegistry struct {
+	sessions map[string]*session
+	mutex    sync.RWMutex
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{sessions: make(map[string]*session)}
+}
+
+// add registers the session of a client, until it's removed.
+func (sr *sessionRegistry) add(r *http.Request, subjects func() []string, stats func() sniffer.ClientStats) *session {
+	s := &session{
+		id:         uuid.NewV4().String(),
+		remoteAddr: r.RemoteAddr,
+		userAgent:  r.UserAgent(),
+		start:      time.Now(),
+		subjects:   subjects,
+		stats:      stats,
+		killed:     make(chan struct{}),
+	}
+
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	sr.sessions[s.id] = s
+
+	return s
+}
+
+func (sr *sessionRegistry) remove(s *session) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+	delete(sr.sessions, s.id)
+}
+
+func (sr *sessionRegistry) get(id string) (*session, bool) {
+	sr.mutex.RLock()
+	defer sr.mutex.RUnlock()
+	s, ok := sr.sessions[id]
+	return s, ok
+}
+
+// list returns every session, oldest first.
+func (sr *sessionRegistry) list() []*session {
+	sr.mutex.RLock()
+	sessions := make([]*session, 0, len(sr.sessions))
+	for _, s := range sr.sessions {
+		sessions = append(sessions, s)
+	}
+	sr.mutex.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].start.Before(sessions[j].start)
+	})
+	return sessions
+}
+
+func (sr *sessionRegistry) len() int {
+	sr.mutex.RLock()
+	defer sr.mutex.RUnlock()
+	return len(sr.sessions)
+}
+
+// ServeSessions handles the sessions admin API:
+//
+//	GET /admin/sessions          lists every session
+//	GET /admin/sessions/<id>     describes a session
+//	DELETE /admin/sessions/<id>  disconnects the client of a session
+func (b *Broker) ServeSessions(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/sessions"), "/")
+	if id == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+			return
+		}
+		sessions := []*sessionBody{}
+		for _, s := range b.sessions.list() {
+			sessions = append(sessions, s.describe())
+		}
+		writeJSON(w, http.StatusOK, sessions)
+		return
+	}
+
+	s, ok := b.sessions.get(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown session [%s].", id), http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.describe())
+	case http.MethodDelete:
+		fmt.Printf("Disconnecting session [%s] of [%s].\n", s.id, s.remoteAddr)
+		s.kill()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// subscriptionBody describes a NATS subscription along with the sniffed
+// subjects it serves and their number of handlers.
+type subscriptionBody struct {
+	Subject         string         `json:"subject"`
+	PendingMessages int            `json:"pending_messages"`
+	PendingBytes    int            `json:"pending_bytes"`
+	Sniffed         map[string]int `json:"sniffed"`
+}
+
+// ServeSubjects handles GET /admin/subjects, listing the NATS subscriptions
+// held.
+func (b *Broker) ServeSubjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m := b.sniffer.Metrics()
+	subscriptions := []*subscriptionBody{}
+	for _, sm := range m.Subscriptions {
+		sb := &subscriptionBody{
+			Subject:         sm.Subject,
+			PendingMessages: sm.PendingMessages,
+			PendingBytes:    sm.PendingBytes,
+			Sniffed:         make(map[string]int),
+		}
+		// subscriptions don't overlap, so every sniffed subject is
+		// served by the only one covering it
+		for subject, handlers := range m.Handlers {
+			if sniffer.SubjectCovers(sm.Subject, subject) {
+				sb.Sniffed[subject] = handlers
+			}
+		}
+		subscriptions = append(subscriptions, sb)
+	}
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].Subject < subscriptions[j].Subject
+	})
+	writeJSON(w, http.StatusOK, subscriptions)
+}
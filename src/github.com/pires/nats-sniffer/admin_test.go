@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+const testAdminToken = "secret"
+
+// adminRequest sends an authenticated request to the admin API and decodes
+// the answer into v, if any.
+func adminRequest(t *testing.T, method string, url string, code int, v interface{}) {
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != code {
+		t.Fatalf("%s %s: expected %d, got %d", method, url, code, resp.StatusCode)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitSessions waits for n sessions to be registered and returns them.
+func waitSessions(t *testing.T, url string, n int) []sessionBody {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var sessions []sessionBody
+		adminRequest(t, http.MethodGet, url+"/admin/sessions", http.StatusOK, &sessions)
+		if len(sessions) == n {
+			return sessions
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d sessions, got %+v", n, sessions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	s, b, srv := runBroker(t)
+	defer stopBroker(s, b, srv)
+
+	for _, token := range []string{"", "Bearer wrong", "Basic " + testAdminToken, testAdminToken} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/admin/sessions", nil)
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("Expected %d for [%s], got %d", http.StatusUnauthorized, token, resp.StatusCode)
+		}
+	}
+	adminRequest(t, http.MethodGet, srv.URL+"/admin/subjects", http.StatusOK, nil)
+}
+
+func TestSessions(t *testing.T) {
+	s, b, srv := runBroker(t)
+	defer stopBroker(s, b, srv)
+
+	adminRequest(t, http.MethodPost, srv.URL+"/admin/sessions", http.StatusMethodNotAllowed, nil)
+	adminRequest(t, http.MethodGet, srv.URL+"/admin/sessions/unknown", http.StatusNotFound, nil)
+	adminRequest(t, http.MethodDelete, srv.URL+"/admin/sessions/unknown", http.StatusNotFound, nil)
+	if sessions := waitSessions(t, srv.URL, 0); len(sessions) != 0 {
+		t.Fatalf("Expected no session, got %+v", sessions)
+	}
+
+	// a stream is a session, ended with an error once killed
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/sniff/?subject=device.>", nil)
+	req.Header.Set("User-Agent", "tester")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := streamEvents(resp.Body)
+	expectEvent(t, events, statusEvent)
+
+	stream := waitSessions(t, srv.URL, 1)[0]
+	if len(stream.Subjects) != 1 || stream.Subjects[0] != "device.>" || stream.UserAgent != "tester" {
+		t.Errorf("Unexpected session: %+v", stream)
+	}
+	var got sessionBody
+	adminRequest(t, http.MethodGet, srv.URL+"/admin/sessions/"+stream.ID, http.StatusOK, &got)
+	if got.ID != stream.ID {
+		t.Errorf("Expected session [%s], got %+v", stream.ID, got)
+	}
+	adminRequest(t, http.MethodPut, srv.URL+"/admin/sessions/"+stream.ID, http.StatusMethodNotAllowed, nil)
+
+	// so is a WebSocket, closed once killed
+	c := dialWebSocket(t, srv.URL)
+	defer c.conn.Close()
+	c.expect(t, statusEvent)
+	c.send(t, map[string]interface{}{"command": "sniff", "subject": "other"})
+	c.expect(t, ackEvent)
+	sessions := waitSessions(t, srv.URL, 2)
+	ws := sessions[1]
+	if sessions[0].ID != stream.ID || len(ws.Subjects) != 1 || ws.Subjects[0] != "other" {
+		t.Errorf("Expected the stream then the WebSocket, got %+v", sessions)
+	}
+
+	adminRequest(t, http.MethodDelete, srv.URL+"/admin/sessions/"+stream.ID, http.StatusNoContent, nil)
+	var killed errorBody
+	json.Unmarshal([]byte(expectEvent(t, events, errorEvent).data), &killed)
+	if killed.Error != ERR_SESSION_KILLED.Error() {
+		t.Errorf("Expected the stream to be told why, got %+v", killed)
+	}
+	select {
+	case e, ok := <-events:
+		if ok {
+			t.Errorf("Expected the stream to end, got %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Timed out waiting for the stream to end")
+	}
+
+	adminRequest(t, http.MethodDelete, srv.URL+"/admin/sessions/"+ws.ID, http.StatusNoContent, nil)
+	if e := c.expect(t, errorEvent); e.Error != ERR_SESSION_KILLED.Error() {
+		t.Errorf("Expected the WebSocket to be told why, got %+v", e)
+	}
+	if e := c.event(t); e != nil {
+		t.Errorf("Expected the WebSocket to be closed, got %+v", e)
+	}
+	waitSessions(t, srv.URL, 0)
+}
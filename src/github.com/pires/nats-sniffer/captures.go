@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pires/nats-sniffer/sniffer"
+	"github.com/satori/go.uuid"
+)
+
+// captureManager records sniffed traffic to capture files on behalf of
+// HTTP clients:
+//
+//	POST /captures                 starts recording, taking the parameters of /sniff/
+//	GET /captures                  lists recordings
+//	GET /captures/<id>             describes a recording
+//	DELETE /captures/<id>          stops recording
+//	GET /captures/<id>/<file>      downloads a capture file
+//
+// Starting and stopping recordings takes the admin token, and at most
+// maxRunning recordings run at once, each writing up to maxBytes. Only the
+// latest keep finished recordings are listed, older ones being forgotten
+// as new ones start. Their files are left in dir.
+type captureManager struct {
+	sniffer    *sniffer.Sniffer
+	dir        string
+	token      string
+	keep       int
+	maxRunning int
+	maxBytes   int64
+	// starting counts recordings not running yet
+	starting int
+	captures map[string]*capture
+	mutex    sync.Mutex
+}
+
+const (
+	// keptCaptures is the number of finished recordings listed by default.
+	keptCaptures = 100
+	// defaultCaptureDuration is how long recordings last unless told
+	// otherwise.
+	defaultCaptureDuration = time.Hour
+)
+
+// capture is a recording started over HTTP.
+type capture struct {
+	id       string
+	subjects []string
+	started  time.Time
+	stopped  time.Time
+	err      error
+	recorder *sniffer.Recorder
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	mutex    sync.Mutex
+}
+
+// captureView describes a recording to HTTP clients.
+type captureView struct {
+	ID       string                `json:"id"`
+	Subjects []string              `json:"subjects"`
+	Started  time.Time             `json:"started"`
+	Stopped  *time.Time            `json:"stopped,omitempty"`
+	Error    string                `json:"error,omitempty"`
+	Stats    sniffer.RecorderStats `json:"stats"`
+}
+
+// newCaptureManager returns a manager recording to dir, on behalf of
+// clients bearing token.
+func newCaptureManager(s *sniffer.Sniffer, dir string, token string) *captureManager {
+	return &captureManager{
+		sniffer:    s,
+		dir:        dir,
+		token:      token,
+		keep:       keptCaptures,
+		maxRunning: *captureMaxRunning,
+		maxBytes:   *captureMaxBytes,
+		captures:   make(map[string]*capture),
+	}
+}
+
+// ServeHTTP handles /captures and /captures/ URLs.
+func (m *captureManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/captures"), "/")
+	parts := strings.SplitN(path, "/", 2)
+	if (r.Method == http.MethodPost || r.Method == http.MethodDelete) && !authorized(r, m.token) {
+		unauthorized(w)
+		return
+	}
+
+	switch {
+	case path == "" && r.Method == http.MethodPost:
+		m.start(w, r)
+	case path == "" && r.Method == http.MethodGet:
+		m.list(w)
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		if c, ok := m.get(w, parts[0]); ok {
+			writeJSON(w, http.StatusOK, c.view())
+		}
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if c, ok := m.get(w, parts[0]); ok {
+			c.halt(nil)
+			<-c.done
+			writeJSON(w, http.StatusOK, c.view())
+		}
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		if c, ok := m.get(w, parts[0]); ok {
+			c.serveFile(w, r, parts[1])
+		}
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// start starts recording the subjects and filters given as query
+// parameters, along with:
+//
+//	max_bytes=<bytes>       start a new file once the current one holds this many bytes
+//	max_age=<duration>      start a new file once the current one is this old
+//	gzip=true               compress files
+//	max_total_bytes=<bytes> stop once files hold this many bytes, up to maxBytes
+//	limit=<count>           stop after count messages
+//	duration=<duration>     stop after a while, an hour by default
+func (m *captureManager) start(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	group, err := newSniffGroup(m.sniffer, q["subject"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filters, err := filtersFromQuery(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, duration, err := limitsFromQuery(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if duration == 0 {
+		duration = defaultCaptureDuration
+	}
+	recorder, err := m.recorderFromQuery(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxBytes := m.maxBytes
+	if value := q.Get("max_total_bytes"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 || n > m.maxBytes {
+			http.Error(w, fmt.Sprintf("Invalid max_total_bytes [%s]: expected a number of bytes up to %d", value, m.maxBytes), http.StatusBadRequest)
+			return
+		}
+		maxBytes = n
+	}
+
+	c := &capture{
+		id:       filepath.Base(recorder.Prefix),
+		subjects: group.subjects,
+		started:  time.Now(),
+		recorder: recorder,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	limiter := newLimiter(limit)
+	handlerFn := func(i int, msg *sniffer.SniffedMessage) {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+		if !limiter.take() {
+			return
+		}
+		if err := recorder.Record(msg); err != nil {
+			c.halt(err)
+		} else if recorder.Stats().Bytes >= maxBytes {
+			c.halt(nil)
+		}
+	}
+	var options []sniffer.SniffOption
+	if len(filters) > 0 {
+		options = append(options, sniffer.WithFilter(sniffer.All(filters...)))
+	}
+
+	// count the recording as running before it starts, so that concurrent
+	// requests can't get past the limit
+	m.mutex.Lock()
+	if m.running()+m.starting >= m.maxRunning {
+		m.mutex.Unlock()
+		http.Error(w, fmt.Sprintf("Too many recordings running, %d at most.", m.maxRunning), http.StatusTooManyRequests)
+		return
+	}
+	m.starting++
+	m.mutex.Unlock()
+
+	err = group.sniff(handlerFn, make([]sniffer.Replay, len(group.subjects)), options...)
+	m.mutex.Lock()
+	m.starting--
+	if err == nil {
+		m.prune()
+		m.captures[c.id] = c
+	}
+	m.mutex.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), sniffStatusCode(err))
+		return
+	}
+
+	go c.run(group, limiter, duration)
+
+	fmt.Printf("Recording [%s] to [%s].\n", group, recorder.Prefix)
+	w.Header().Set("Location", "/captures/"+c.id)
+	writeJSON(w, http.StatusCreated, c.view())
+}
+
+// recorderFromQuery returns a recorder for a new capture, with its
+// rotation and compression taken from query parameters.
+func (m *captureManager) recorderFromQuery(q url.Values) (*sniffer.Recorder, error) {
+	r := sniffer.NewRecorder(filepath.Join(m.dir, uuid.NewV4().String()))
+
+	if value := q.Get("max_bytes"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid max_bytes [%s]: expected a number of bytes", value)
+		}
+		r.MaxBytes = n
+	}
+	if value := q.Get("max_age"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("Invalid max_age [%s]: expected a duration, e.g. 1h", value)
+		}
+		r.MaxAge = d
+	}
+	if value := q.Get("gzip"); value != "" {
+		compress, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid gzip [%s]: expected true or false", value)
+		}
+		r.Compress = compress
+	}
+
+	return r, nil
+}
+
+func (m *captureManager) list(w http.ResponseWriter) {
+	m.mutex.Lock()
+	views := make([]*captureView, 0, len(m.captures))
+	for _, c := range m.captures {
+		views = append(views, c.view())
+	}
+	m.mutex.Unlock()
+
+	sort.Slice(views, func(i, j int) bool {
+		return views[i].Started.Before(views[j].Started)
+	})
+	writeJSON(w, http.StatusOK, views)
+}
+
+// get returns a capture, answering 404 if there's no such capture.
+func (m *captureManager) get(w http.ResponseWriter, id string) (*capture, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c, ok := m.captures[id]
+	if !ok {
+		http.Error(w, "No such capture.", http.StatusNotFound)
+	}
+	return c, ok
+}
+
+// running returns the number of recordings running. The lock is assumed to
+// be held upon entering.
+func (m *captureManager) running() int {
+	running := 0
+	for _, c := range m.captures {
+		select {
+		case <-c.done:
+		default:
+			running++
+		}
+	}
+	return running
+}
+
+// prune forgets the oldest finished recordings past the number to keep.
+// The lock is assumed to be held upon entering.
+func (m *captureManager) prune() {
+	var finished []*capture
+	for _, c := range m.captures {
+		select {
+		case <-c.done:
+			finished = append(finished, c)
+		default:
+		}
+	}
+	if len(finished) <= m.keep {
+		return
+	}
+
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].started.Before(finished[j].started)
+	})
+	for _, c := range finished[:len(finished)-m.keep] {
+		delete(m.captures, c.id)
+	}
+}
+
+// stopAll stops every recording and waits for their files to be closed.
+func (m *captureManager) stopAll() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, c := range m.captures {
+		c.halt(nil)
+		<-c.done
+	}
+}
+
+// run records until the capture is halted, has enough messages, time is
+// up or the recorder can't keep up.
+func (c *capture) run(group *sniffGroup, limiter *limiter, duration time.Duration) {
+	var timeout <-chan time.Time
+	if duration > 0 {
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-c.stop:
+	case <-limiter.done():
+	case <-timeout:
+	case <-group.done():
+		// a stopping sniffer isn't the recorder's fault
+		err := group.err()
+		if err == sniffer.ERR_SNIFFER_STOPPED {
+			err = nil
+		}
+		c.halt(err)
+	}
+	group.unsniff()
+	closeErr := c.recorder.Close()
+
+	c.mutex.Lock()
+	if c.err == nil {
+		c.err = closeErr
+	}
+	c.stopped = time.Now()
+	c.mutex.Unlock()
+
+	stats := c.recorder.Stats()
+	fmt.Printf("Recorded %d messages to %d files [%s].\n", stats.Records, len(stats.Files), c.id)
+	close(c.done)
+}
+
+// halt stops recording, for err if not nil.
+func (c *capture) halt(err error) {
+	c.stopOnce.Do(func() {
+		c.mutex.Lock()
+		c.err = err
+		c.mutex.Unlock()
+		close(c.stop)
+	})
+}
+
+func (c *capture) view() *captureView {
+	stats := c.recorder.Stats()
+	for i, file := range stats.Files {
+		stats.Files[i] = filepath.Base(file)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	v := &captureView{
+		ID:       c.id,
+		Subjects: c.subjects,
+		Started:  c.started,
+		Stats:    stats,
+	}
+	if !c.stopped.IsZero() {
+		stopped := c.stopped
+		v.Stopped = &stopped
+	}
+	if c.err != nil {
+		v.Error = c.err.Error()
+	}
+	return v
+}
+
+// serveFile sends one of the capture files.
+func (c *capture) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	for _, file := range c.recorder.Stats().Files {
+		if filepath.Base(file) == name {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+			http.ServeFile(w, r, file)
+			return
+		}
+	}
+	http.Error(w, "No such capture file.", http.StatusNotFound)
+}
+
+// writeJSON answers with v as JSON.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("Error encoding response: %s\n", err.Error())
+	}
+}
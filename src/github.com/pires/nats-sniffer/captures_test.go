@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// runCaptures starts a sniffer fed by Inject, along with a capture manager
+// recording to a temporary directory.
+func runCaptures(t *testing.T) (*sniffer.Sniffer, *captureManager, *httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "captures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := sniffer.NewSniffer("", sniffer.WithoutConn())
+	s.Start()
+	m := newCaptureManager(s, dir, testAdminToken)
+	srv := httptest.NewServer(m)
+	return s, m, srv, func() {
+		srv.Close()
+		m.stopAll()
+		s.Stop(context.Background())
+		os.RemoveAll(dir)
+	}
+}
+
+// captureRequest sends an authenticated request to the capture manager and
+// decodes the answer into v, if any.
+func captureRequest(t *testing.T, method string, url string, code int, v interface{}) {
+	req, _ := http.NewRequest(method, url, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != code {
+		t.Fatalf("%s %s: expected %d, got %d", method, url, code, resp.StatusCode)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// waitStopped waits for a capture to stop and returns how it ended.
+func waitStopped(t *testing.T, m *captureManager, id string) *captureView {
+	m.mutex.Lock()
+	c := m.captures[id]
+	m.mutex.Unlock()
+	select {
+	case <-c.done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for capture [%s] to stop", id)
+	}
+	return c.view()
+}
+
+func TestCaptureLimit(t *testing.T) {
+	s, m, srv, stop := runCaptures(t)
+	defer stop()
+
+	var v captureView
+	captureRequest(t, http.MethodPost, srv.URL+"/captures?subject=device.>&limit=2", http.StatusCreated, &v)
+	for i := 0; i < 3; i++ {
+		s.Inject(&sniffer.SniffedMessage{Subject: "device.a", Data: []byte("A"), Size: 1, Timestamp: time.Now()})
+	}
+	if v := waitStopped(t, m, v.ID); v.Error != "" || v.Stats.Records != 2 || v.Stopped == nil {
+		t.Errorf("Expected 2 records, got %+v", v)
+	}
+}
+
+func TestCaptureSnifferStopped(t *testing.T) {
+	s, m, srv, stop := runCaptures(t)
+	defer stop()
+
+	var v captureView
+	captureRequest(t, http.MethodPost, srv.URL+"/captures?subject=device.>", http.StatusCreated, &v)
+	s.Stop(context.Background())
+	if v := waitStopped(t, m, v.ID); v.Error != "" {
+		t.Errorf("Expected a stopping sniffer not to fail the capture, got %s", v.Error)
+	}
+}
+
+func TestCapturesPruned(t *testing.T) {
+	_, m, srv, stop := runCaptures(t)
+	defer stop()
+	m.keep = 2
+
+	var ids []string
+	for i := 0; i < 4; i++ {
+		var v captureView
+		captureRequest(t, http.MethodPost, srv.URL+"/captures?subject=device.>", http.StatusCreated, &v)
+		captureRequest(t, http.MethodDelete, srv.URL+"/captures/"+v.ID, http.StatusOK, nil)
+		ids = append(ids, v.ID)
+	}
+	var running captureView
+	captureRequest(t, http.MethodPost, srv.URL+"/captures?subject=device.>", http.StatusCreated, &running)
+
+	// the latest finished ones are kept, along with running ones
+	var views []captureView
+	captureRequest(t, http.MethodGet, srv.URL+"/captures", http.StatusOK, &views)
+	if len(views) != 3 || views[0].ID != ids[2] || views[1].ID != ids[3] || views[2].ID != running.ID {
+		t.Errorf("Expected captures %v, got %+v", []string{ids[2], ids[3], running.ID}, views)
+	}
+	captureRequest(t, http.MethodGet, srv.URL+"/captures/"+ids[0], http.StatusNotFound, nil)
+}
+
+func TestCaptureBounds(t *testing.T) {
+	s, m, srv, stop := runCaptures(t)
+	defer stop()
+	m.maxRunning = 1
+	m.maxBytes = 1000
+
+	// starting and stopping takes the admin token, unlike listing
+	for _, method := range []string{http.MethodPost, http.MethodDelete} {
+		req, _ := http.NewRequest(method, srv.URL+"/captures?subject=device.>", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected %d, got %d", method, http.StatusUnauthorized, resp.StatusCode)
+		}
+	}
+	resp, err := http.Get(srv.URL + "/captures")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected %d listing, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	captureRequest(t, http.MethodPost, srv.URL+"/captures?subject=device.>&max_total_bytes=1001", http.StatusBadRequest, nil)
+	var v captureView
+	captureRequest(t, http.MethodPost, srv.URL+"/captures?subject=device.>&max_total_bytes=100", http.StatusCreated, &v)
+	captureRequest(t, http.MethodPost, srv.URL+"/captures?subject=device.>", http.StatusTooManyRequests, nil)
+
+	// recording stops once files hold enough bytes
+	for i := 0; i < 10; i++ {
+		s.Inject(&sniffer.SniffedMessage{Subject: "device.a", Data: []byte("0123456789"), Size: 10, Timestamp: time.Now()})
+	}
+	if v := waitStopped(t, m, v.ID); v.Error != "" || v.Stats.Bytes < 100 || v.Stats.Records == 10 {
+		t.Errorf("Expected recording to stop past 100 bytes, got %+v", v)
+	}
+	captureRequest(t, http.MethodPost, srv.URL+"/captures?subject=device.>", http.StatusCreated, nil)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// Exit codes of commands, grep style.
+const (
+	// exitMessages means at least a message was handled.
+	exitMessages = 0
+	// exitNoMessages means no message was handled.
+	exitNoMessages = 1
+	// exitUsage means the command line is invalid.
+	exitUsage = 2
+	// exitFailure means the command failed, e.g. NATS is unreachable or
+	// the terminal couldn't keep up.
+	exitFailure = 3
+)
+
+// connectionFlags are global flags telling how to connect to NATS, which
+// commands take too.
+var connectionFlags = []string{
+	"nats", "nats-user", "nats-password-file", "nats-token-file", "nats-ca", "nats-cert", "nats-key",
+}
+
+// sniffingFlags are global flags telling how to sniff, which commands
+// sniffing subjects take too.
+var sniffingFlags = []string{"queue-size", "slow-consumer"}
+
+// servingFlags are global flags telling how to serve HTTP clients, which
+// commands serving them take too.
+var servingFlags = []string{
+	"port", "history-size", "history-bytes", "heartbeat", "stats-interval", "shutdown-timeout",
+	"capture-dir", "capture-max-running", "capture-max-bytes", "admin-token-file",
+	"discover", "discover-root", "discover-max",
+}
+
+// filterFlags are the filters of /sniff/, taken by commands as repeatable
+// flags.
+var filterFlags = []struct {
+	name  string
+	usage string
+}{
+	{"contains", "Only keep payloads containing text"},
+	{"regex", "Only keep payloads matching a regular expression"},
+	{"json", "Only keep JSON payloads whose field compares to a value, e.g. device.battery<20"},
+	{"min_size", "Only keep payloads of at least this many bytes"},
+	{"max_size", "Only keep payloads of at most this many bytes"},
+	{"exclude", "Leave out messages whose subject matches a pattern, e.g. device.*.heartbeat"},
+}
+
+// addGlobalFlags makes fs take global flags too.
+func addGlobalFlags(fs *flag.FlagSet, names []string) {
+	for _, name := range names {
+		f := flag.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+}
+
+// addFilterFlags makes fs take the filters of /sniff/, collected in q.
+func addFilterFlags(fs *flag.FlagSet, q url.Values) {
+	for _, f := range filterFlags {
+		fs.Var(&queryFlag{q: q, name: f.name}, f.name, f.usage)
+	}
+}
+
+// parseArgs parses flags and arguments, which may come in any order, and
+// returns the arguments.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var parsed []string
+	for rest := args; ; rest = fs.Args()[1:] {
+		if err := fs.Parse(rest); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return parsed, nil
+		}
+		parsed = append(parsed, fs.Arg(0))
+	}
+}
+
+// queryFlag collects repeated flags as query parameters.
+type queryFlag struct {
+	q    url.Values
+	name string
+}
+
+func (f *queryFlag) String() string {
+	return strings.Join(f.q[f.name], ",")
+}
+
+func (f *queryFlag) Set(value string) error {
+	f.q.Add(f.name, value)
+	return nil
+}
+
+// subjectCommand holds what commands sniffing subjects from the command
+// line have in common: connection and filter flags, subjects and when to
+// stop.
+type subjectCommand struct {
+	fs       *flag.FlagSet
+	q        url.Values
+	count    *uint64
+	duration *time.Duration
+	subjects []string
+}
+
+// newSubjectCommand returns a command with the given name and usage, to
+// which more flags may be added before parsing.
+func newSubjectCommand(name string, usage string) *subjectCommand {
+	c := &subjectCommand{
+		fs: flag.NewFlagSet(name, flag.ContinueOnError),
+		q:  url.Values{},
+	}
+	addGlobalFlags(c.fs, connectionFlags)
+	addGlobalFlags(c.fs, sniffingFlags)
+	addFilterFlags(c.fs, c.q)
+	c.count = c.fs.Uint64("count", 0, "Exit after this many messages")
+	c.duration = c.fs.Duration("duration", 0, "Exit after sniffing this long")
+	c.fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s\n", os.Args[0], usage)
+		c.fs.PrintDefaults()
+	}
+	return c
+}
+
+// parse parses flags and subjects, which may come in any order.
+func (c *subjectCommand) parse(args []string) bool {
+	subjects, err := parseArgs(c.fs, args)
+	if err != nil {
+		return false
+	}
+	c.subjects = subjects
+	if len(c.subjects) == 0 {
+		c.fs.Usage()
+		return false
+	}
+	return true
+}
+
+// run sniffs the subjects, calling handler for every message, until enough
+// messages were handled, time is up, the user had enough or handler can't
+// keep up or fails. It returns the number of messages handled along with an exit
+// code.
+func (c *subjectCommand) run(handler func(msg *sniffer.SniffedMessage) error) (uint64, int) {
+	filters, err := filtersFromQuery(c.q)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 0, exitUsage
+	}
+	s, err := newSniffer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 0, exitUsage
+	}
+	group, err := newSniffGroup(s, c.subjects)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 0, exitUsage
+	}
+
+	if err := s.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error connecting to NATS: %s\n", err.Error())
+		return 0, exitFailure
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		s.Stop(ctx)
+	}()
+
+	limiter := newLimiter(*c.count)
+	var handled uint64
+	// the first handler error stops everything, e.g. a full disk
+	failed := make(chan struct{})
+	var failOnce sync.Once
+	handlerFn := func(i int, msg *sniffer.SniffedMessage) {
+		select {
+		case <-failed:
+			return
+		default:
+		}
+		if !limiter.take() {
+			return
+		}
+		if err := handler(msg); err != nil {
+			failOnce.Do(func() {
+				fmt.Fprintf(os.Stderr, "Error handling message: %s\n", err.Error())
+				close(failed)
+			})
+			return
+		}
+		atomic.AddUint64(&handled, 1)
+	}
+	var options []sniffer.SniffOption
+	if len(filters) > 0 {
+		options = append(options, sniffer.WithFilter(sniffer.All(filters...)))
+	}
+	if err := group.sniff(handlerFn, make([]sniffer.Replay, len(group.subjects)), options...); err != nil {
+		fmt.Fprintf(os.Stderr, "Error sniffing subjects [%s]: %s\n", group, err.Error())
+		return 0, exitFailure
+	}
+
+	var timeout <-chan time.Time
+	if *c.duration > 0 {
+		timer := time.NewTimer(*c.duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	code := exitMessages
+	select {
+	case <-limiter.done():
+	case <-timeout:
+	case <-signals:
+	case <-group.done():
+		fmt.Fprintln(os.Stderr, sniffer.ERR_SLOW_CONSUMER.Error())
+		code = exitFailure
+	case <-failed:
+		code = exitFailure
+	}
+	stats := group.stats()
+	group.unsniff()
+
+	n := atomic.LoadUint64(&handled)
+	if stats.Dropped > 0 {
+		fmt.Fprintf(os.Stderr, "%d messages dropped.\n", stats.Dropped)
+	}
+	if code == exitMessages && n == 0 {
+		code = exitNoMessages
+	}
+	return n, code
+}
+
+// sniffMain runs the sniff command, which prints messages of the given
+// subjects to stdout, and returns its exit code.
+func sniffMain(args []string) int {
+	c := newSubjectCommand("sniff", "sniff [flags] <subject>...")
+	format := c.fs.String("format", lineFormat, "Output format (line, raw, json, hex, dump or template)")
+	tmpl := c.fs.String("template", "", "Go text/template to print every message with, e.g. '{{.Subject}} {{string .Data}}'")
+	color := c.fs.String("color", "auto", "Colorize subjects (auto, always or never)")
+	if !c.parse(args) {
+		return exitUsage
+	}
+
+	colorize, err := useColor(*color)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+	p, err := newPrinter(os.Stdout, *format, *tmpl, colorize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+
+	printed, code := c.run(p.print)
+	fmt.Fprintf(os.Stderr, "%d messages printed.\n", printed)
+	return code
+}
+
+// recordMain runs the record command, which writes messages of the given
+// subjects to capture files, and returns its exit code.
+func recordMain(args []string) int {
+	c := newSubjectCommand("record", "record [flags] <subject>...")
+	prefix := c.fs.String("o", "capture", "Path capture files are named after, e.g. captures/incident-42")
+	maxBytes := c.fs.Int64("max-bytes", 0, "Start a new capture file once the current one holds this many bytes")
+	maxAge := c.fs.Duration("max-age", 0, "Start a new capture file once the current one is this old")
+	compress := c.fs.Bool("gzip", false, "Compress capture files")
+	if !c.parse(args) {
+		return exitUsage
+	}
+
+	r := sniffer.NewRecorder(*prefix)
+	r.MaxBytes = *maxBytes
+	r.MaxAge = *maxAge
+	r.Compress = *compress
+
+	recorded, code := c.run(r.Record)
+	if err := r.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error closing capture file: %s\n", err.Error())
+		code = exitFailure
+	}
+	stats := r.Stats()
+	fmt.Fprintf(os.Stderr, "%d messages recorded to %s.\n", recorded, strings.Join(stats.Files, ", "))
+	return code
+}
+
+// useColor tells whether to colorize output. auto colorizes when stdout
+// is a terminal.
+func useColor(mode string) (bool, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		fi, err := os.Stdout.Stat()
+		return err == nil && fi.Mode()&os.ModeCharDevice != 0, nil
+	}
+	return false, fmt.Errorf("Unknown color mode [%s].", mode)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	gnatsd "github.com/nats-io/gnatsd/test"
+	natsclient "github.com/nats-io/nats"
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+func TestPrinter(t *testing.T) {
+	msg := &sniffer.SniffedMessage{
+		Subject:   "device.a",
+		Reply:     "inbox",
+		Data:      []byte("he\x01lo"),
+		Size:      5,
+		Timestamp: time.Date(2017, 3, 1, 12, 34, 56, 1000, time.Local),
+		Sequence:  3,
+	}
+
+	for _, test := range []struct {
+		format   string
+		tmpl     string
+		expected string
+	}{
+		{lineFormat, "", "12:34:56.000001 device.a reply inbox 5 bytes: he.lo\n"},
+		{rawFormat, "", "he\x01lo\n"},
+		{hexFormat, "", "12:34:56.000001 device.a reply inbox 5 bytes\n00000000  68 65 01 6c 6f                                    |he.lo|\n"},
+		{"", "{{.Subject}} {{.Sequence}} {{string .Data}}", "device.a 3 he\x01lo\n"},
+		{jsonFormat, "", `"payload": "he\u0001lo"`},
+	} {
+		var buf bytes.Buffer
+		p, err := newPrinter(&buf, test.format, test.tmpl, false)
+		if err != nil {
+			t.Fatalf("%s: %v", test.format, err)
+		}
+		if err := p.print(msg); err != nil {
+			t.Fatalf("%s: %v", test.format, err)
+		}
+		if test.format == jsonFormat {
+			if !strings.Contains(buf.String(), test.expected) {
+				t.Errorf("%s: expected the payload as text, got %s", test.format, buf.String())
+			}
+		} else if buf.String() != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.format, test.expected, buf.String())
+		}
+	}
+
+	// subjects are painted, always the same
+	var buf bytes.Buffer
+	p, _ := newPrinter(&buf, lineFormat, "", true)
+	p.print(msg)
+	p.print(msg)
+	lines := strings.Split(buf.String(), "\n")
+	if !strings.Contains(lines[0], "\x1b[") || lines[0] != lines[1] {
+		t.Errorf("Expected subjects painted the same, got %q", buf.String())
+	}
+
+	for _, test := range []struct {
+		format string
+		tmpl   string
+	}{
+		{"xml", ""},
+		{templateFormat, ""},
+		{"", "{{.Subject"},
+	} {
+		if _, err := newPrinter(&buf, test.format, test.tmpl, false); err == nil {
+			t.Errorf("Expected format [%s] with template [%s] to be refused", test.format, test.tmpl)
+		}
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	msg := &sniffer.SniffedMessage{
+		Subject: "device.a",
+		Data:    []byte(`{"z": 1, "a": 12345678901234567890, "m": [1.50, "x"]}`),
+	}
+	var buf bytes.Buffer
+	if err := prettyJSON(&buf, msg); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	// the envelope keeps its order, the payload its keys and numbers
+	expected := []string{`"subject": "device.a"`, `"payload": {`, `"z": 1`, `"a": 12345678901234567890`, `1.50`, `"size": 0`}
+	last := -1
+	for _, s := range expected {
+		i := strings.Index(out, s)
+		if i <= last {
+			t.Fatalf("Expected %s after %v, got %s", s, expected[:len(expected)-1], out)
+		}
+		last = i
+	}
+	if !strings.HasSuffix(out, "}\n") {
+		t.Errorf("Expected a line per envelope, got %q", out)
+	}
+
+	// other payloads stay text
+	buf.Reset()
+	msg.Data = []byte(`{"z": 1`)
+	if err := prettyJSON(&buf, msg); err != nil || !strings.Contains(buf.String(), `"payload": "{\"z\": 1"`) {
+		t.Errorf("Expected the payload as text, got %s (%v)", buf.String(), err)
+	}
+}
+
+// captureStdout returns what f writes to stdout.
+func captureStdout(t *testing.T, f func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		out <- b
+	}()
+
+	f()
+	os.Stdout = stdout
+	w.Close()
+	return string(<-out)
+}
+
+func TestSniffExitCodes(t *testing.T) {
+	// commands set global flags
+	natsURL := *nats
+	defer func() { *nats = natsURL }()
+
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = testPort
+	srv := gnatsd.RunServer(&opts)
+	defer srv.Shutdown()
+	url := fmt.Sprintf("nats://localhost:%d", testPort)
+	nc, err := natsclient.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	// keep publishing, so that sniffing gets messages whenever it starts
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(10 * time.Millisecond):
+				nc.Publish("device.a", []byte("hello"))
+			}
+		}
+	}()
+
+	for _, test := range []struct {
+		args []string
+		code int
+		out  string
+	}{
+		{[]string{"-nats", url, "-count", "2", "-format", "raw", "device.>"}, exitMessages, "hello\nhello\n"},
+		{[]string{"-nats", url, "-duration", "100ms", "other"}, exitNoMessages, ""},
+		{[]string{"-nats", url, "-duration", "100ms", "-contains", "nothing", "device.>"}, exitNoMessages, ""},
+		{[]string{"-nats", url}, exitUsage, ""},
+		{[]string{"-nats", url, "-format", "xml", "device.>"}, exitUsage, ""},
+		{[]string{"-nats", url, "-color", "pink", "device.>"}, exitUsage, ""},
+		{[]string{"-nats", url, "-json", "<", "device.>"}, exitUsage, ""},
+		{[]string{"-nats", url, "device..a"}, exitUsage, ""},
+		{[]string{"-nats", "nats://localhost:1", "device.>"}, exitFailure, ""},
+	} {
+		var code int
+		out := captureStdout(t, func() {
+			code = sniffMain(test.args)
+		})
+		if code != test.code || out != test.out {
+			t.Errorf("%v: expected %d and %q, got %d and %q", test.args, test.code, test.out, code, out)
+		}
+	}
+
+	// the first handler error stops recording, e.g. with a file in the way
+	// of the capture directory
+	notDir, err := ioutil.TempFile("", "capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notDir.Close()
+	defer os.Remove(notDir.Name())
+	began := time.Now()
+	if code := recordMain([]string{"-nats", url, "-o", notDir.Name() + "/capture", "-duration", "5s", "device.>"}); code != exitFailure {
+		t.Errorf("Expected %d recording where it can't be written, got %d", exitFailure, code)
+	}
+	if elapsed := time.Since(began); elapsed > 2*time.Second {
+		t.Errorf("Expected recording to stop at the first error, took %v", elapsed)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// subjectsHandler handles GET /subjects, describing the subjects discovered
+// so far as a tree of tokens:
+//
+//	subject=<subject>    the node to start from, the root by default
+//	depth=<levels>       how many levels to describe, every level by default
+type subjectsHandler struct {
+	tree *sniffer.SubjectTree
+}
+
+func (h *subjectsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var depth int
+	if value := r.URL.Query().Get("depth"); value != "" {
+		d, err := strconv.Atoi(value)
+		if err != nil || d < 0 {
+			http.Error(w, fmt.Sprintf("Invalid depth [%s]: expected a number of levels", value), http.StatusBadRequest)
+			return
+		}
+		depth = d
+	}
+	subject := r.URL.Query().Get("subject")
+	node, ok := h.tree.Node(subject, depth)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown subject [%s].", subject), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, node)
+}
+
+// discoverSubjects discovers the subjects under root, serving them at
+// /subjects.
+func discoverSubjects(s *sniffer.Sniffer, root string) error {
+	tree := sniffer.NewSubjectTree(*discoverMax)
+	if err := s.Discover(root, tree); err != nil {
+		return err
+	}
+	http.Handle("/subjects", &subjectsHandler{tree: tree})
+	return nil
+}
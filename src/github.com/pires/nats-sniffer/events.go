@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// Server-sent event types. Every event holds a JSON body.
+const (
+	messageEvent   = "message"
+	statusEvent    = "status"
+	errorEvent     = "error"
+	statsEvent     = "stats"
+	exchangeEvent  = "exchange"
+	heartbeatEvent = "heartbeat"
+	shutdownEvent  = "shutdown"
+)
+
+// messageStream writes sniffed messages and other events to a client, in
+// a format the client asked for.
+type messageStream interface {
+	// open calls start and, if it succeeds, begins the stream. Messages
+	// sent while start runs are held until the stream begins, so that
+	// start can fail with a proper HTTP status code instead.
+	open(start func() error) error
+	// sendMessage writes a message sniffed for the i-th subject.
+	sendMessage(i int, msg *sniffer.SniffedMessage)
+	// send writes a named event holding v.
+	send(event string, v interface{})
+	// heartbeat keeps idle streams from being cut.
+	heartbeat()
+}
+
+// retryHint tells browsers how long to wait before reconnecting.
+const retryHint = 3 * time.Second
+
+// eventStream writes server-sent events to a client. Events may be sent
+// from several goroutines, e.g. message and status handlers.
+type eventStream struct {
+	w http.ResponseWriter
+	f http.Flusher
+	// sequences holds the last message sequence of every sniffed subject
+	sequences []uint64
+	// events sent before the stream begins are held, until it does
+	begun bool
+	held  bytes.Buffer
+	mutex sync.Mutex
+}
+
+// newEventStream returns a stream for messages of as many sniffed subjects
+// as there are replays, resuming from them if they resume.
+func newEventStream(w http.ResponseWriter, f http.Flusher, replays []sniffer.Replay) *eventStream {
+	es := &eventStream{
+		w:         w,
+		f:         f,
+		sequences: make([]uint64, len(replays)),
+	}
+	for i, replay := range replays {
+		if replay.Resume {
+			es.sequences[i] = replay.After
+		}
+	}
+	return es
+}
+
+// errorBody is the body of error events.
+type errorBody struct {
+	Error string `json:"error"`
+}
+
+// statsBody is the body of stats events: the delivery counters of the
+// client, along with the traffic of its subjects.
+type statsBody struct {
+	sniffer.ClientStats
+	Traffic []sniffer.TrafficStats `json:"traffic"`
+}
+
+// heartbeatBody is the body of heartbeat events.
+type heartbeatBody struct {
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// open calls start and, if it succeeds, begins the stream. Events sent
+// while start runs are held until the stream begins, so that start can
+// fail with a proper HTTP status code instead. The lock isn't held while
+// start runs, so that handlers it starts can send events, or be stopped
+// should start fail.
+func (es *eventStream) open(start func() error) error {
+	if err := start(); err != nil {
+		return err
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	// set the headers related to event streaming.
+	es.w.Header().Set("Content-Type", "text/event-stream")
+	es.w.Header().Set("Cache-Control", "no-cache")
+	es.w.Header().Set("Connection", "keep-alive")
+	fmt.Fprintf(es.w, "retry: %d\n\n", retryHint/time.Millisecond)
+	es.held.WriteTo(es.w)
+	es.begun = true
+	es.f.Flush()
+
+	return nil
+}
+
+// send writes a named event holding v as JSON.
+func (es *eventStream) send(event string, v interface{}) {
+	es.write("", event, "", v)
+}
+
+// sendMessage writes a message event sniffed for the i-th subject. The
+// event id holds the last sequence of every subject, comma separated, so
+// that reconnecting browsers resume right after it.
+func (es *eventStream) sendMessage(i int, msg *sniffer.SniffedMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		fmt.Printf("Error encoding %s event: %s\n", messageEvent, err.Error())
+		return
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	es.sequences[i] = msg.Sequence
+	ids := make([]string, len(es.sequences))
+	for j, sequence := range es.sequences {
+		ids[j] = strconv.FormatUint(sequence, 10)
+	}
+	es.writeEvent("", messageEvent, strings.Join(ids, ","), data)
+}
+
+// heartbeat writes a comment, which keeps proxies from cutting idle
+// streams, along with a heartbeat event for clients to check liveness.
+func (es *eventStream) heartbeat() {
+	es.write("heartbeat", heartbeatEvent, "", &heartbeatBody{Timestamp: time.Now()})
+}
+
+// write writes a named event holding v as JSON, preceded by a comment and
+// with an id unless they're empty.
+func (es *eventStream) write(comment string, event string, id string, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		fmt.Printf("Error encoding %s event: %s\n", event, err.Error())
+		return
+	}
+
+	es.mutex.Lock()
+	defer es.mutex.Unlock()
+
+	es.writeEvent(comment, event, id, data)
+}
+
+// writeEvent writes an event holding JSON data, or holds it until the
+// stream begins. The lock is assumed to be held upon entering.
+func (es *eventStream) writeEvent(comment string, event string, id string, data []byte) {
+	var w io.Writer = es.w
+	if !es.begun {
+		w = &es.held
+	}
+	if comment != "" {
+		fmt.Fprintf(w, ": %s\n", comment)
+	}
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\n", event)
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	if es.begun {
+		es.f.Flush()
+	}
+}
+
+// sniffStatusCode maps a sniffing error to an HTTP status code.
+func sniffStatusCode(err error) int {
+	switch err {
+	case sniffer.ERR_INVALID_SUBJECT:
+		return http.StatusBadRequest
+	case sniffer.ERR_NATS_CONN_CLOSED, sniffer.ERR_SNIFFER_STOPPED:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
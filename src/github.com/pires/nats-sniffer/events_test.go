@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// runBroker starts a sniffer fed by Inject, along with a broker serving it
+// over HTTP.
+func runBroker(t *testing.T) (*sniffer.Sniffer, *Broker, *httptest.Server) {
+	s := sniffer.NewSniffer("", sniffer.WithoutConn())
+	if err := s.Start(); err != nil {
+		t.Fatalf("Error starting sniffer: %v", err)
+	}
+	b := NewBroker(s)
+	mux := http.NewServeMux()
+	mux.Handle("/sniff/", b)
+	mux.Handle("/sniff.ndjson", b)
+	mux.HandleFunc("/ws", b.ServeWebSocket)
+	mux.HandleFunc("/metrics", b.ServeMetrics)
+	mux.Handle("/admin/", adminHandler(b, testAdminToken))
+	return s, b, httptest.NewServer(mux)
+}
+
+// stopBroker stops everything runBroker started.
+func stopBroker(s *sniffer.Sniffer, b *Broker, srv *httptest.Server) {
+	select {
+	case <-b.quit:
+	default:
+		b.Shutdown()
+	}
+	srv.Close()
+	s.Stop(context.Background())
+}
+
+// withIntervals sets the heartbeat and stats intervals until the returned
+// function is called.
+func withIntervals(heartbeat time.Duration, stats time.Duration) func() {
+	oldHeartbeat, oldStats := *heartbeatInterval, *statsInterval
+	*heartbeatInterval, *statsInterval = heartbeat, stats
+	return func() {
+		*heartbeatInterval, *statsInterval = oldHeartbeat, oldStats
+	}
+}
+
+// sseEvent is an event as read off the wire.
+type sseEvent struct {
+	comment string
+	id      string
+	event   string
+	data    string
+}
+
+// readEvent reads the next event, or fails with io.EOF once the stream
+// ends.
+func readEvent(r *bufio.Reader) (*sseEvent, error) {
+	e := &sseEvent{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if e.event != "" {
+				return e, nil
+			}
+		case strings.HasPrefix(line, ": "):
+			e.comment = line[2:]
+		case strings.HasPrefix(line, "id: "):
+			e.id = line[4:]
+		case strings.HasPrefix(line, "event: "):
+			e.event = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			e.data = line[6:]
+		}
+	}
+}
+
+// expectEvent reads events until one of the given type, skipping heartbeats
+// and stats unless they're expected.
+func expectEvent(t *testing.T, events chan *sseEvent, event string) *sseEvent {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("Stream ended waiting for %s event", event)
+			}
+			if e.event == event {
+				return e
+			}
+			if e.event != heartbeatEvent && e.event != statsEvent {
+				t.Fatalf("Expected %s event, got %+v", event, e)
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for %s event", event)
+		}
+	}
+}
+
+// streamEvents reads the events of a stream until it ends.
+func streamEvents(body io.Reader) chan *sseEvent {
+	events := make(chan *sseEvent, 64)
+	go func() {
+		defer close(events)
+		r := bufio.NewReader(body)
+		for {
+			e, err := readEvent(r)
+			if err != nil {
+				return
+			}
+			events <- e
+		}
+	}()
+	return events
+}
+
+func TestEventStream(t *testing.T) {
+	defer withIntervals(100*time.Millisecond, 150*time.Millisecond)()
+	s, b, srv := runBroker(t)
+	defer stopBroker(s, b, srv)
+
+	resp, err := http.Get(srv.URL + "/sniff/?subject=device.>&subject=other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Unexpected response: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	r := bufio.NewReader(resp.Body)
+	if line, err := r.ReadString('\n'); err != nil || line != "retry: 3000\n" {
+		t.Fatalf("Expected a retry hint first, got %q", line)
+	}
+	events := streamEvents(r)
+
+	var status sniffer.ConnectionStatus
+	e := expectEvent(t, events, statusEvent)
+	if err := json.Unmarshal([]byte(e.data), &status); err != nil || status.State != sniffer.Offline {
+		t.Fatalf("Unexpected status event: %+v", e)
+	}
+
+	// message ids hold the last sequence of every subject, which are
+	// delivered in any order
+	s.Inject(&sniffer.SniffedMessage{Subject: "device.a", Data: []byte("A"), Size: 1, Timestamp: time.Now()})
+	s.Inject(&sniffer.SniffedMessage{Subject: "other", Data: []byte("B"), Size: 1, Timestamp: time.Now()})
+	firstIDs := map[string]string{"device.a": "1,0", "other": "0,1"}
+	for i := 0; i < 2; i++ {
+		e := expectEvent(t, events, messageEvent)
+		var msg map[string]interface{}
+		if err := json.Unmarshal([]byte(e.data), &msg); err != nil {
+			t.Fatal(err)
+		}
+		subject, _ := msg["subject"].(string)
+		expected := firstIDs[subject]
+		if i == 1 {
+			expected = "1,1"
+		}
+		if e.id != expected {
+			t.Errorf("Expected %s with id %s, got %+v", subject, expected, e)
+		}
+	}
+
+	if e := expectEvent(t, events, heartbeatEvent); e.comment != "heartbeat" || !strings.Contains(e.data, "timestamp") {
+		t.Errorf("Unexpected heartbeat: %+v", e)
+	}
+	var stats statsBody
+	e = expectEvent(t, events, statsEvent)
+	if err := json.Unmarshal([]byte(e.data), &stats); err != nil || stats.Delivered != 2 || len(stats.Traffic) != 2 {
+		t.Errorf("Unexpected stats event: %+v", e)
+	}
+
+	b.Shutdown()
+	if e := expectEvent(t, events, shutdownEvent); !strings.Contains(e.data, "shutting down") {
+		t.Errorf("Unexpected shutdown event: %+v", e)
+	}
+	select {
+	case e, ok := <-events:
+		if ok {
+			t.Errorf("Expected the stream to end, got %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the stream to end")
+	}
+}
+
+func TestEventStreamErrors(t *testing.T) {
+	s, b, srv := runBroker(t)
+	defer stopBroker(s, b, srv)
+
+	for _, test := range []struct {
+		query string
+		code  int
+	}{
+		{"subject=device..x", http.StatusBadRequest},
+		{"subject=a&limit=x", http.StatusBadRequest},
+		{"subject=a&json=%3C", http.StatusBadRequest},
+	} {
+		resp, err := http.Get(srv.URL + "/sniff/?" + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code || resp.Header.Get("Content-Type") == "text/event-stream" {
+			t.Errorf("Expected %d for %s, got %d %s", test.code, test.query, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+	}
+
+	// refused before the stream begins once the sniffer stops
+	s.Stop(context.Background())
+	resp, err := http.Get(srv.URL + "/sniff/?subject=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d once stopped, got %d", http.StatusServiceUnavailable, resp.StatusCode)
+	}
+}
+
+// Handlers started by open must be able to send while it runs, so that
+// they can be stopped should it fail.
+func TestStreamOpen(t *testing.T) {
+	msg := &sniffer.SniffedMessage{Subject: "a.x", Data: []byte("A"), Size: 1, Sequence: 7}
+	for _, newStream := range []func(w *httptest.ResponseRecorder) messageStream{
+		func(w *httptest.ResponseRecorder) messageStream {
+			return newEventStream(w, w, make([]sniffer.Replay, 1))
+		},
+		func(w *httptest.ResponseRecorder) messageStream {
+			return newNDJSONStream(w, w)
+		},
+	} {
+		for _, fail := range []bool{true, false} {
+			w := httptest.NewRecorder()
+			stream := newStream(w)
+			err := stream.open(func() error {
+				sent := make(chan struct{})
+				go func() {
+					stream.sendMessage(0, msg)
+					close(sent)
+				}()
+				select {
+				case <-sent:
+				case <-time.After(2 * time.Second):
+					t.Fatalf("%T: sending blocked while opening", stream)
+				}
+				if fail {
+					return sniffer.ERR_NATS_CONN_CLOSED
+				}
+				return nil
+			})
+
+			switch {
+			case fail && (err == nil || w.Body.Len() > 0):
+				t.Errorf("%T: expected nothing sent on failure, got %v %q", stream, err, w.Body.String())
+			case !fail && (err != nil || !strings.Contains(w.Body.String(), `"sequence":7`)):
+				t.Errorf("%T: expected the held message once open, got %v %q", stream, err, w.Body.String())
+			}
+		}
+	}
+}
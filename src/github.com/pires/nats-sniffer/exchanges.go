@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// exchangeQueueSize is the number of exchanges buffered for each client,
+// past which they're dropped.
+const exchangeQueueSize = 256
+
+// exchangesFromQuery tells whether a client wants the request/reply
+// exchanges of its subjects too, with exchanges=true.
+func exchangesFromQuery(q url.Values) (bool, error) {
+	value := q.Get("exchanges")
+	if value == "" {
+		return false, nil
+	}
+	exchanges, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid exchanges [%s]: expected true or false", value)
+	}
+	return exchanges, nil
+}
+
+// watchExchanges sends the exchanges whose request was sniffed for the
+// group and matches filter, if any, to the returned channel, until the
+// returned function is called. Exchanges the client can't keep up with
+// are dropped.
+func watchExchanges(g *sniffGroup, filter sniffer.Filter) (<-chan *sniffer.Exchange, func()) {
+	exchanges := make(chan *sniffer.Exchange, exchangeQueueSize)
+	id := g.sniffer.WatchExchanges(func(e *sniffer.Exchange) {
+		if !g.covers(e.Request.Subject) || (filter != nil && !filter.Match(e.Request)) {
+			return
+		}
+		select {
+		case exchanges <- e:
+		default:
+		}
+	})
+	return exchanges, func() {
+		g.sniffer.UnwatchExchanges(id)
+	}
+}
+
+// ServeLatency handles GET /latency, returning the request latencies and
+// timeouts of every subject requests were sniffed on.
+func (b *Broker) ServeLatency(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, b.sniffer.LatencyStats())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// filtersFromQuery builds the filters requested by query parameters. Every
+// parameter but the size bounds may be repeated, and messages must match
+// all of them:
+//
+//	contains=<text>           payload contains text
+//	regex=<expression>        payload matches a regular expression
+//	json=<field><op><value>   JSON payload field comparison, e.g. device.firmware=1.0.0
+//	min_size=<bytes>          payload is at least this big
+//	max_size=<bytes>          payload is at most this big
+//	exclude=<pattern>         subject doesn't match a pattern, e.g. device.*.heartbeat
+func filtersFromQuery(q url.Values) ([]sniffer.Filter, error) {
+	var filters []sniffer.Filter
+
+	for _, substr := range q["contains"] {
+		filters = append(filters, sniffer.Contains(substr))
+	}
+	for _, expr := range q["regex"] {
+		f, err := sniffer.Regexp(expr)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	for _, expr := range q["json"] {
+		f, err := sniffer.JSONField(expr)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+
+	if patterns := q["exclude"]; len(patterns) > 0 {
+		f, err := sniffer.Exclude(patterns...)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+
+	min, err := sizeParam(q, "min_size")
+	if err != nil {
+		return nil, err
+	}
+	max, err := sizeParam(q, "max_size")
+	if err != nil {
+		return nil, err
+	}
+	if min >= 0 || max >= 0 {
+		f, err := sniffer.SizeRange(min, max)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+
+	return filters, nil
+}
+
+// sizeParam parses a size query parameter, returning -1 if it's missing.
+func sizeParam(q url.Values, name string) (int, error) {
+	value := q.Get(name)
+	if value == "" {
+		return -1, nil
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("Invalid %s [%s]: expected a number of bytes", name, value)
+	}
+	return size, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"sync"
+	"text/template"
+	"unicode"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// Output formats of the sniff command.
+const (
+	lineFormat     = "line"
+	rawFormat      = "raw"
+	jsonFormat     = "json"
+	hexFormat      = "hex"
+	dumpFormat     = "dump"
+	templateFormat = "template"
+)
+
+// subjectColors are the ANSI colors subjects are painted with.
+var subjectColors = []int{31, 32, 33, 34, 35, 36}
+
+// templateFuncs are available to user-supplied templates, on top of the
+// text/template builtins.
+var templateFuncs = template.FuncMap{
+	// string renders a payload as text, e.g. {{string .Data}}
+	"string": func(b []byte) string {
+		return string(b)
+	},
+	// json renders anything as JSON, e.g. {{json .}}
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// printer writes sniffed messages in a human or machine friendly format,
+// one at a time.
+type printer struct {
+	w      io.Writer
+	format string
+	tmpl   *template.Template
+	color  bool
+	mutex  sync.Mutex
+}
+
+// newPrinter returns a printer writing messages to w in the given format.
+// A template, if any, implies the template format.
+func newPrinter(w io.Writer, format string, tmpl string, color bool) (*printer, error) {
+	p := &printer{
+		w:      w,
+		format: format,
+		color:  color,
+	}
+	if tmpl != "" {
+		p.format = templateFormat
+	}
+
+	switch p.format {
+	case lineFormat, rawFormat, jsonFormat, hexFormat, dumpFormat:
+	case templateFormat:
+		if tmpl == "" {
+			return nil, fmt.Errorf("The %s format requires a template.", templateFormat)
+		}
+		if !strings.HasSuffix(tmpl, "\n") {
+			tmpl += "\n"
+		}
+		t, err := template.New("message").Funcs(templateFuncs).Parse(tmpl)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid template: %s", err.Error())
+		}
+		p.tmpl = t
+	default:
+		return nil, fmt.Errorf("Unknown format [%s].", format)
+	}
+
+	return p, nil
+}
+
+// print writes a message.
+func (p *printer) print(msg *sniffer.SniffedMessage) error {
+	var buf bytes.Buffer
+	switch p.format {
+	case rawFormat:
+		buf.Write(msg.Data)
+		buf.WriteByte('\n')
+	case jsonFormat:
+		if err := prettyJSON(&buf, msg); err != nil {
+			return err
+		}
+	case dumpFormat:
+		if err := sniffer.NewDumpWriter(&buf).Write(msg); err != nil {
+			return err
+		}
+	case hexFormat:
+		p.header(&buf, msg)
+		buf.WriteByte('\n')
+		buf.WriteString(hex.Dump(msg.Data))
+	case templateFormat:
+		if err := p.tmpl.Execute(&buf, msg); err != nil {
+			return err
+		}
+	default:
+		p.header(&buf, msg)
+		buf.WriteString(": ")
+		buf.WriteString(printable(msg.Data))
+		buf.WriteByte('\n')
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	_, err := p.w.Write(buf.Bytes())
+	return err
+}
+
+// header writes a tcpdump like summary of a message.
+func (p *printer) header(buf *bytes.Buffer, msg *sniffer.SniffedMessage) {
+	fmt.Fprintf(buf, "%s ", msg.Timestamp.Format("15:04:05.000000"))
+	if msg.Op != "" {
+		fmt.Fprintf(buf, "%s ", msg.Op)
+	}
+	buf.WriteString(p.paint(msg.Subject))
+	if msg.Reply != "" {
+		fmt.Fprintf(buf, " reply %s", msg.Reply)
+	}
+	fmt.Fprintf(buf, " %d bytes", msg.Size)
+	if msg.Conn != "" {
+		fmt.Fprintf(buf, " conn %s", msg.Conn)
+	}
+}
+
+// paint colorizes a subject, if enabled. A subject always gets the same
+// color, so that related messages stand out.
+func (p *printer) paint(subject string) string {
+	if !p.color {
+		return subject
+	}
+	h := fnv.New32a()
+	h.Write([]byte(subject))
+	return fmt.Sprintf("\x1b[%dm%s\x1b[0m", subjectColors[h.Sum32()%uint32(len(subjectColors))], subject)
+}
+
+// prettyJSON writes an indented JSON envelope. JSON payloads are embedded
+// as is rather than as text, so that they get indented too while keeping
+// their keys in order and their numbers intact.
+func prettyJSON(buf *bytes.Buffer, msg *sniffer.SniffedMessage) error {
+	envelope := msg.Envelope()
+	var payload json.RawMessage
+	if json.Unmarshal(msg.Data, &payload) == nil {
+		envelope.Payload = payload
+	}
+	b, err := json.MarshalIndent(envelope, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	buf.WriteByte('\n')
+	return nil
+}
+
+// printable replaces non printable characters of a payload with dots.
+func printable(data []byte) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) {
+			return r
+		}
+		return '.'
+	}, string(data))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// limitsFromQuery reads when a client wants its stream to end, so that
+// shell scripts terminate deterministically:
+//
+//	limit=<count>          after count messages
+//	duration=<duration>    after a while, e.g. 30s
+//
+// Zero means no limit.
+func limitsFromQuery(q url.Values) (uint64, time.Duration, error) {
+	var limit uint64
+	var duration time.Duration
+
+	if value := q.Get("limit"); value != "" {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid limit [%s]: expected a number of messages", value)
+		}
+		limit = n
+	}
+	if value := q.Get("duration"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return 0, 0, fmt.Errorf("Invalid duration [%s]: expected a duration, e.g. 30s", value)
+		}
+		duration = d
+	}
+
+	return limit, duration, nil
+}
+
+// limiter lets a number of messages through, if limited, and tells when
+// they all went through.
+type limiter struct {
+	// accessed atomically
+	count uint64
+
+	limit   uint64
+	reached chan struct{}
+	once    sync.Once
+}
+
+func newLimiter(limit uint64) *limiter {
+	return &limiter{
+		limit:   limit,
+		reached: make(chan struct{}),
+	}
+}
+
+// take tells whether one more message may go through.
+func (l *limiter) take() bool {
+	if l.limit == 0 {
+		return true
+	}
+	n := atomic.AddUint64(&l.count, 1)
+	if n >= l.limit {
+		l.once.Do(func() { close(l.reached) })
+	}
+	return n <= l.limit
+}
+
+// done returns a channel that's closed once the limit is reached.
+func (l *limiter) done() <-chan struct{} {
+	return l.reached
+}
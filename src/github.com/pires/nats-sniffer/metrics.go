@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// metricsContentType is the media type of the Prometheus text format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// connectionStates are the states exported, one of which is current.
+var connectionStates = []sniffer.ConnectionState{
+	sniffer.Connected, sniffer.Disconnected, sniffer.Reconnected, sniffer.Closed, sniffer.Reconnecting, sniffer.Offline,
+}
+
+// labelEscaper escapes label values, which may hold anything.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ServeMetrics handles GET /metrics, describing what the sniffer has been
+// up to in the Prometheus text format.
+func (b *Broker) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	m := b.sniffer.Metrics()
+	w.Header().Set("Content-Type", metricsContentType)
+
+	writeMetric(w, "nats_sniffer_http_clients", "gauge", "Number of HTTP clients sniffing, over WebSockets included.",
+		sample{value: float64(b.sessions.len())})
+	writeMetric(w, "nats_sniffer_messages_received_total", "counter", "Number of messages received from NATS.",
+		sample{value: float64(m.Received)})
+	writeMetric(w, "nats_sniffer_messages_delivered_total", "counter", "Number of messages delivered to clients.",
+		sample{value: float64(m.Delivered)})
+	writeMetric(w, "nats_sniffer_messages_dropped_total", "counter", "Number of messages dropped for clients being too slow.",
+		sample{value: float64(m.Dropped)})
+	writeMetric(w, "nats_sniffer_reconnects_total", "counter", "Number of times the NATS connection was got back.",
+		sample{value: float64(m.Reconnects)})
+
+	var states []sample
+	for _, state := range connectionStates {
+		var value float64
+		if state == m.State {
+			value = 1
+		}
+		states = append(states, sample{labels: []string{"state", string(state)}, value: value})
+	}
+	writeMetric(w, "nats_sniffer_connection_state", "gauge", "Current state of the NATS connection.", states...)
+
+	sort.Slice(m.Subscriptions, func(i, j int) bool {
+		return m.Subscriptions[i].Subject < m.Subscriptions[j].Subject
+	})
+	writeMetric(w, "nats_sniffer_subscriptions", "gauge", "Number of NATS subscriptions held.",
+		sample{value: float64(len(m.Subscriptions))})
+	var pendingMessages, pendingBytes []sample
+	for _, sm := range m.Subscriptions {
+		labels := []string{"subject", sm.Subject}
+		pendingMessages = append(pendingMessages, sample{labels: labels, value: float64(sm.PendingMessages)})
+		pendingBytes = append(pendingBytes, sample{labels: labels, value: float64(sm.PendingBytes)})
+	}
+	writeMetric(w, "nats_sniffer_subscription_pending_messages", "gauge", "Number of messages received by a NATS subscription, not handled yet.", pendingMessages...)
+	writeMetric(w, "nats_sniffer_subscription_pending_bytes", "gauge", "Number of payload bytes received by a NATS subscription, not handled yet.", pendingBytes...)
+
+	subjects := make([]string, 0, len(m.Handlers))
+	for subject := range m.Handlers {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	var handlers []sample
+	for _, subject := range subjects {
+		handlers = append(handlers, sample{labels: []string{"subject", subject}, value: float64(m.Handlers[subject])})
+	}
+	writeMetric(w, "nats_sniffer_handlers", "gauge", "Number of handlers of a sniffed subject.", handlers...)
+}
+
+// sample is a value of a metric, along with its labels as name and value
+// pairs.
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// writeMetric writes a metric in the Prometheus text format.
+func writeMetric(w io.Writer, name string, kind string, help string, samples ...sample) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+	for _, s := range samples {
+		var labels []string
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, s.labels[i], labelEscaper.Replace(s.labels[i+1])))
+		}
+		value := strconv.FormatFloat(s.value, 'f', -1, 64)
+		if len(labels) > 0 {
+			fmt.Fprintf(w, "%s{%s} %s\n", name, strings.Join(labels, ","), value)
+		} else {
+			fmt.Fprintf(w, "%s %s\n", name, value)
+		}
+	}
+}
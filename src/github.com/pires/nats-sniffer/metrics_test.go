@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// metricFamily is a metric as read off /metrics.
+type metricFamily struct {
+	help    string
+	kind    string
+	samples []metricSample
+}
+
+type metricSample struct {
+	labels string
+	value  string
+}
+
+var sampleLine = regexp.MustCompile(`^([a-z_]+)(?:\{(.*)\})? (\S+)$`)
+
+// readMetrics parses the Prometheus text format, failing unless every
+// metric comes with its HELP and TYPE lines, before its samples.
+func readMetrics(t *testing.T, body []byte) ([]string, map[string]*metricFamily) {
+	var names []string
+	families := make(map[string]*metricFamily)
+	var current *metricFamily
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			fields := strings.SplitN(line, " ", 4)
+			if _, ok := families[fields[2]]; ok {
+				t.Fatalf("Metric %s described twice", fields[2])
+			}
+			current = &metricFamily{help: fields[3]}
+			families[fields[2]] = current
+			names = append(names, fields[2])
+		case strings.HasPrefix(line, "# TYPE "):
+			fields := strings.SplitN(line, " ", 4)
+			if current == nil || fields[2] != names[len(names)-1] || current.help == "" {
+				t.Fatalf("Expected TYPE after HELP, got %q", line)
+			}
+			current.kind = fields[3]
+		default:
+			m := sampleLine.FindStringSubmatch(line)
+			if m == nil {
+				t.Fatalf("Unexpected line %q", line)
+			}
+			if current == nil || m[1] != names[len(names)-1] || current.kind == "" {
+				t.Fatalf("Expected HELP and TYPE before %q", line)
+			}
+			current.samples = append(current.samples, metricSample{labels: m[2], value: m[3]})
+		}
+	}
+	return names, families
+}
+
+func TestMetrics(t *testing.T) {
+	s, b, srv := runBroker(t)
+	defer stopBroker(s, b, srv)
+
+	// discovery doesn't show as a subscription nor as handlers
+	if err := s.Discover(">", sniffer.NewSubjectTree(0)); err != nil {
+		t.Fatal(err)
+	}
+	for _, subject := range []string{"b.>", `a"b\c`, "b.>"} {
+		if _, err := s.Sniff(subject, func(msg *sniffer.SniffedMessage) {}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != metricsContentType {
+		t.Errorf("Expected %s, got %s", metricsContentType, resp.Header.Get("Content-Type"))
+	}
+	var body bytes.Buffer
+	body.ReadFrom(resp.Body)
+	names, families := readMetrics(t, body.Bytes())
+	if len(names) != 10 {
+		t.Errorf("Expected 10 metrics, got %v", names)
+	}
+	for _, name := range names {
+		if kind := families[name].kind; kind != "gauge" && kind != "counter" {
+			t.Errorf("Unexpected type of %s: %s", name, kind)
+		}
+	}
+
+	var current []metricSample
+	for _, sample := range families["nats_sniffer_connection_state"].samples {
+		if sample.value == "1" {
+			current = append(current, sample)
+		} else if sample.value != "0" {
+			t.Errorf("Unexpected connection state value: %+v", sample)
+		}
+	}
+	if len(current) != 1 || current[0].labels != `state="offline"` {
+		t.Errorf("Expected a single current state, offline, got %+v", current)
+	}
+
+	// subjects are sorted and escaped
+	expected := []metricSample{{`subject="a\"b\\c"`, "1"}, {`subject="b.>"`, "2"}}
+	if handlers := families["nats_sniffer_handlers"].samples; len(handlers) != 2 || handlers[0] != expected[0] || handlers[1] != expected[1] {
+		t.Errorf("Expected handlers %+v, got %+v", expected, handlers)
+	}
+	if subscriptions := families["nats_sniffer_subscriptions"].samples; len(subscriptions) != 1 || subscriptions[0].value != "2" {
+		t.Errorf("Expected 2 subscriptions, got %+v", subscriptions)
+	}
+	pending := families["nats_sniffer_subscription_pending_messages"].samples
+	if len(pending) != 2 || pending[0].labels != expected[0].labels || pending[1].labels != expected[1].labels {
+		t.Errorf("Expected pending messages of %+v, got %+v", expected, pending)
+	}
+
+	var buf bytes.Buffer
+	writeMetric(&buf, "m", "gauge", "Help.", sample{labels: []string{"a", "x\ny"}, value: 1.5})
+	if buf.String() != "# HELP m Help.\n# TYPE m gauge\nm{a=\"x\\ny\"} 1.5\n" {
+		t.Errorf("Unexpected metric: %q", buf.String())
+	}
+}
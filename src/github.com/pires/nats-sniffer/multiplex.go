@@ -0,0 +1,411 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+var (
+	ERR_ALREADY_SNIFFING = errors.New("Subject is already being sniffed.")
+	ERR_NOT_SNIFFING     = errors.New("Subject isn't being sniffed.")
+)
+
+// Commands sent by WebSocket clients.
+const (
+	sniffCommand   = "sniff"
+	unsniffCommand = "unsniff"
+	pauseCommand   = "pause"
+	resumeCommand  = "resume"
+	filterCommand  = "filter"
+)
+
+// ackEvent confirms a WebSocket command succeeded.
+const ackEvent = "ack"
+
+// wsCommand is a command sent by a WebSocket client, e.g.
+//
+//	{"command": "sniff", "subject": "device.>", "filter": "json=device.battery<20", "history": 10}
+type wsCommand struct {
+	Command string `json:"command"`
+	Subject string `json:"subject"`
+	// Filter has the same syntax as the filter query parameters of
+	// /sniff/, e.g. contains=ALERT&min_size=10.
+	Filter string `json:"filter"`
+	// History and Since select recent messages to replay, just like the
+	// query parameters of /sniff/.
+	History int    `json:"history"`
+	Since   string `json:"since"`
+}
+
+// wsEvent is sent to WebSocket clients. Type is one of the server-sent
+// event types or ack, and Subject the sniffed subject it relates to.
+type wsEvent struct {
+	Type    string                    `json:"type"`
+	Command string                    `json:"command,omitempty"`
+	Subject string                    `json:"subject,omitempty"`
+	Message *sniffer.SniffedMessage   `json:"message,omitempty"`
+	Status  *sniffer.ConnectionStatus `json:"status,omitempty"`
+	Stats   *sniffer.ClientStats      `json:"stats,omitempty"`
+	Traffic *sniffer.TrafficStats     `json:"traffic,omitempty"`
+	Error   string                    `json:"error,omitempty"`
+	Reason  string                    `json:"reason,omitempty"`
+}
+
+// wsSniff is a subject sniffed over a WebSocket. It filters its own
+// messages, so that it can be paused or filtered differently without
+// sniffing again.
+type wsSniff struct {
+	subject string
+	id      string
+	paused  bool
+	filter  sniffer.Filter
+	mutex   sync.RWMutex
+}
+
+// Match drops messages while paused and applies the current filter.
+func (sn *wsSniff) Match(msg *sniffer.SniffedMessage) bool {
+	sn.mutex.RLock()
+	defer sn.mutex.RUnlock()
+	return !sn.paused && (sn.filter == nil || sn.filter.Match(msg))
+}
+
+// wsSession holds everything a WebSocket client sniffs.
+type wsSession struct {
+	broker *Broker
+	ws     *websocket
+	sniffs map[string]*wsSniff
+	mutex  sync.Mutex
+}
+
+// ServeWebSocket handles GET /ws URL. Clients sniff as many subjects as
+// they want over a single WebSocket, sending commands and receiving
+// events tagged by subject.
+func (b *Broker) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := upgradeWebSocket(w, r)
+	if err != nil {
+		fmt.Printf("Error upgrading to WebSocket: %s\n", err.Error())
+		return
+	}
+	// clients answer pings, so give them a couple of heartbeats
+	ws.readTimeout = 2**heartbeatInterval + webSocketWriteTimeout
+
+	fmt.Printf("Incoming WebSocket client [%s].\n", r.RemoteAddr)
+
+	s := &wsSession{
+		broker: b,
+		ws:     ws,
+		sniffs: make(map[string]*wsSniff),
+	}
+
+	// let the client know about NATS connection state changes
+	status := b.sniffer.Status()
+	s.send(&wsEvent{Type: statusEvent, Status: &status})
+	watchId := b.sniffer.Watch(func(status *sniffer.ConnectionStatus) {
+		s.send(&wsEvent{Type: statusEvent, Status: status})
+	})
+	defer b.sniffer.Unwatch(watchId)
+
+	// let administrators see who sniffs what
+	session := b.sessions.add(r, s.subjects, s.stats)
+
+	gone := make(chan error, 1)
+	go func() {
+		gone <- s.serve()
+	}()
+
+	heartbeats := time.NewTicker(*heartbeatInterval)
+	defer heartbeats.Stop()
+	statsTicks := time.NewTicker(*statsInterval)
+	defer statsTicks.Stop()
+
+	// wait until client goes away or the service shuts down
+	var readErr error
+loop:
+	for {
+		select {
+		case <-heartbeats.C:
+			ws.ping()
+		case <-statsTicks.C:
+			s.sendStats()
+		case readErr = <-gone:
+			break loop
+		case <-session.killed:
+			s.send(&wsEvent{Type: errorEvent, Error: ERR_SESSION_KILLED.Error()})
+			ws.close(closePolicy, "")
+			readErr = <-gone
+			break loop
+		case <-b.quit:
+			s.send(&wsEvent{Type: shutdownEvent, Reason: "Sniffer is shutting down."})
+			ws.close(closeGoingAway, "")
+			readErr = <-gone
+			break loop
+		}
+	}
+	ws.close(closeCode(readErr), "")
+	if readErr != io.EOF && readErr != ERR_WEBSOCKET_CLOSED {
+		fmt.Printf("WebSocket client error [%s]: %s\n", r.RemoteAddr, readErr.Error())
+	}
+
+	b.sessions.remove(session)
+	n := s.close()
+	fmt.Printf("WebSocket client gone [%s], was sniffing %d subjects.\n", r.RemoteAddr, n)
+}
+
+// serve handles commands until the client goes away or misbehaves.
+func (s *wsSession) serve() error {
+	for {
+		_, data, err := s.ws.readMessage()
+		if err != nil {
+			return err
+		}
+
+		var cmd wsCommand
+		if err := json.Unmarshal(data, &cmd); err != nil {
+			s.send(&wsEvent{Type: errorEvent, Error: fmt.Sprintf("Invalid command: %s", err.Error())})
+			continue
+		}
+		if err := s.handle(&cmd); err != nil {
+			s.send(&wsEvent{Type: errorEvent, Command: cmd.Command, Subject: cmd.Subject, Error: err.Error()})
+			continue
+		}
+		s.send(&wsEvent{Type: ackEvent, Command: cmd.Command, Subject: cmd.Subject})
+	}
+}
+
+func (s *wsSession) handle(cmd *wsCommand) error {
+	switch cmd.Command {
+	case sniffCommand:
+		return s.sniff(cmd)
+	case unsniffCommand:
+		return s.unsniff(cmd.Subject)
+	case pauseCommand:
+		return s.pause(cmd.Subject, true)
+	case resumeCommand:
+		return s.pause(cmd.Subject, false)
+	case filterCommand:
+		return s.filter(cmd.Subject, cmd.Filter)
+	}
+	return fmt.Errorf("Unknown command [%s].", cmd.Command)
+}
+
+// sniff starts sniffing a subject.
+func (s *wsSession) sniff(cmd *wsCommand) error {
+	filter, err := wsFilter(cmd.Filter)
+	if err != nil {
+		return err
+	}
+	var replay sniffer.Replay
+	if cmd.History < 0 {
+		return fmt.Errorf("Invalid history [%d]: expected a number of messages", cmd.History)
+	}
+	replay.Count = cmd.History
+	if cmd.Since != "" {
+		d, err := time.ParseDuration(cmd.Since)
+		if err != nil || d < 0 {
+			return fmt.Errorf("Invalid since [%s]: expected a duration, e.g. 5m", cmd.Since)
+		}
+		replay.Since = d
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.sniffs[cmd.Subject]; ok {
+		return ERR_ALREADY_SNIFFING
+	}
+	sn := &wsSniff{subject: cmd.Subject, filter: filter}
+	id, err := s.broker.sniffer.Sniff(cmd.Subject, func(msg *sniffer.SniffedMessage) {
+		s.send(&wsEvent{Type: messageEvent, Subject: sn.subject, Message: msg})
+	}, sniffer.WithFilter(sn), sniffer.WithReplay(replay))
+	if err != nil {
+		return err
+	}
+	sn.id = id
+	s.sniffs[cmd.Subject] = sn
+	go s.watch(sn)
+
+	return nil
+}
+
+// watch lets the client know if the sniffer stops delivering a subject,
+// e.g. for the client being too slow, and why.
+func (s *wsSession) watch(sn *wsSniff) {
+	<-s.broker.sniffer.Done(sn.subject, sn.id)
+
+	s.mutex.Lock()
+	current := s.sniffs[sn.subject] == sn
+	if current {
+		delete(s.sniffs, sn.subject)
+	}
+	s.mutex.Unlock()
+
+	// unsniffed by the client
+	if !current {
+		return
+	}
+	// too slow, or the sniffer is stopping
+	err := s.broker.sniffer.Err(sn.subject, sn.id)
+	if err == nil {
+		err = sniffer.ERR_SNIFFER_STOPPED
+	}
+	s.broker.sniffer.Unsniff(sn.subject, sn.id)
+	s.send(&wsEvent{Type: errorEvent, Subject: sn.subject, Error: err.Error()})
+}
+
+// unsniff stops sniffing a subject.
+func (s *wsSession) unsniff(subject string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sn, ok := s.sniffs[subject]
+	if !ok {
+		return ERR_NOT_SNIFFING
+	}
+	delete(s.sniffs, subject)
+	s.broker.sniffer.Unsniff(subject, sn.id)
+
+	return nil
+}
+
+// pause stops or resumes delivering a subject, or every subject if none
+// is given. Messages arriving while paused are dropped.
+func (s *wsSession) pause(subject string, paused bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if subject == "" {
+		for _, sn := range s.sniffs {
+			sn.mutex.Lock()
+			sn.paused = paused
+			sn.mutex.Unlock()
+		}
+		return nil
+	}
+
+	sn, ok := s.sniffs[subject]
+	if !ok {
+		return ERR_NOT_SNIFFING
+	}
+	sn.mutex.Lock()
+	sn.paused = paused
+	sn.mutex.Unlock()
+
+	return nil
+}
+
+// filter replaces the filter of a subject. An empty one lets every
+// message through.
+func (s *wsSession) filter(subject string, query string) error {
+	filter, err := wsFilter(query)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sn, ok := s.sniffs[subject]
+	if !ok {
+		return ERR_NOT_SNIFFING
+	}
+	sn.mutex.Lock()
+	sn.filter = filter
+	sn.mutex.Unlock()
+
+	return nil
+}
+
+// subjects returns the sniffed subjects.
+func (s *wsSession) subjects() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	subjects := make([]string, 0, len(s.sniffs))
+	for subject := range s.sniffs {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+	return subjects
+}
+
+// stats returns the delivery counters of every sniffed subject added up.
+func (s *wsSession) stats() sniffer.ClientStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var total sniffer.ClientStats
+	for subject, sn := range s.sniffs {
+		if stats, ok := s.broker.sniffer.ClientStats(subject, sn.id); ok {
+			total.Delivered += stats.Delivered
+			total.Dropped += stats.Dropped
+			total.Filtered += stats.Filtered
+			total.Pending += stats.Pending
+		}
+	}
+	return total
+}
+
+// sendStats sends the delivery counters and traffic of every sniffed
+// subject.
+func (s *wsSession) sendStats() {
+	s.mutex.Lock()
+	events := make([]*wsEvent, 0, len(s.sniffs))
+	for subject, sn := range s.sniffs {
+		if stats, ok := s.broker.sniffer.ClientStats(subject, sn.id); ok {
+			e := &wsEvent{Type: statsEvent, Subject: subject, Stats: &stats}
+			if traffic, ok := s.broker.sniffer.SubjectTrafficStats(subject); ok {
+				e.Traffic = &traffic
+			}
+			events = append(events, e)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, e := range events {
+		s.send(e)
+	}
+}
+
+// send writes an event to the client. Failures show up when reading, as
+// the connection gets closed.
+func (s *wsSession) send(e *wsEvent) {
+	if err := s.ws.writeJSON(e); err != nil && err != ERR_WEBSOCKET_CLOSED {
+		s.ws.conn.Close()
+	}
+}
+
+// close stops sniffing everything and returns how many subjects were
+// being sniffed.
+func (s *wsSession) close() int {
+	s.mutex.Lock()
+	sniffs := s.sniffs
+	s.sniffs = make(map[string]*wsSniff)
+	s.mutex.Unlock()
+
+	for subject, sn := range sniffs {
+		s.broker.sniffer.Unsniff(subject, sn.id)
+	}
+	return len(sniffs)
+}
+
+// wsFilter builds the filter described by a query, if any.
+func wsFilter(query string) (sniffer.Filter, error) {
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid filter [%s]: %s", query, err.Error())
+	}
+	filters, err := filtersFromQuery(q)
+	if err != nil || len(filters) == 0 {
+		return nil, err
+	}
+	return sniffer.All(filters...), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+func TestWebSocketCommands(t *testing.T) {
+	s, b, srv := runBroker(t)
+	defer stopBroker(s, b, srv)
+
+	c := dialWebSocket(t, srv.URL)
+	defer c.conn.Close()
+	c.expect(t, statusEvent)
+
+	c.send(t, map[string]interface{}{"command": "sniff", "subject": "device.>"})
+	if e := c.expect(t, ackEvent); e.Command != sniffCommand || e.Subject != "device.>" {
+		t.Errorf("Unexpected ack: %+v", e)
+	}
+	c.send(t, map[string]interface{}{"command": "sniff", "subject": "other", "filter": "contains=B"})
+	c.expect(t, ackEvent)
+
+	// messages are tagged by the subject they're sniffed for, and
+	// filtered by subject
+	s.Inject(&sniffer.SniffedMessage{Subject: "device.a", Data: []byte("A"), Size: 1, Timestamp: time.Now()})
+	if e := c.expect(t, messageEvent); e.Subject != "device.>" || e.Message["subject"] != "device.a" {
+		t.Errorf("Unexpected message: %+v", e)
+	}
+	s.Inject(&sniffer.SniffedMessage{Subject: "other", Data: []byte("A"), Size: 1, Timestamp: time.Now()})
+	s.Inject(&sniffer.SniffedMessage{Subject: "other", Data: []byte("B"), Size: 1, Timestamp: time.Now()})
+	if e := c.expect(t, messageEvent); e.Subject != "other" || e.Message["payload"] != "B" {
+		t.Errorf("Unexpected message: %+v", e)
+	}
+
+	for _, test := range []struct {
+		command map[string]interface{}
+		err     string
+	}{
+		{map[string]interface{}{"command": "sniff", "subject": "device.>"}, ERR_ALREADY_SNIFFING.Error()},
+		{map[string]interface{}{"command": "sniff", "subject": "device..x"}, sniffer.ERR_INVALID_SUBJECT.Error()},
+		{map[string]interface{}{"command": "sniff", "subject": "x", "history": -1}, "Invalid history [-1]: expected a number of messages"},
+		{map[string]interface{}{"command": "unsniff", "subject": "nothing"}, ERR_NOT_SNIFFING.Error()},
+		{map[string]interface{}{"command": "jump"}, "Unknown command [jump]."},
+	} {
+		c.send(t, test.command)
+		if e := c.expect(t, errorEvent); e.Error != test.err {
+			t.Errorf("Expected %q for %v, got %+v", test.err, test.command, e)
+		}
+	}
+
+	c.send(t, map[string]interface{}{"command": "unsniff", "subject": "device.>"})
+	if e := c.expect(t, ackEvent); e.Command != unsniffCommand {
+		t.Errorf("Unexpected ack: %+v", e)
+	}
+	// nothing for device.> anymore
+	s.Inject(&sniffer.SniffedMessage{Subject: "device.a", Data: []byte("A"), Size: 1, Timestamp: time.Now()})
+	s.Inject(&sniffer.SniffedMessage{Subject: "other", Data: []byte("B"), Size: 1, Timestamp: time.Now()})
+	if e := c.expect(t, messageEvent); e.Subject != "other" {
+		t.Errorf("Expected a message of other only, got %+v", e)
+	}
+
+	// a stopping sniffer isn't blamed on the client
+	s.Stop(context.Background())
+	if e := c.expect(t, errorEvent); e.Subject != "other" || e.Error != sniffer.ERR_SNIFFER_STOPPED.Error() {
+		t.Errorf("Unexpected error once stopped: %+v", e)
+	}
+
+	b.Shutdown()
+	if e := c.expect(t, shutdownEvent); e.Reason == "" {
+		t.Errorf("Expected a shutdown reason: %+v", e)
+	}
+	if e := c.event(t); e != nil {
+		t.Errorf("Expected the WebSocket to be closed, got %+v", e)
+	}
+}
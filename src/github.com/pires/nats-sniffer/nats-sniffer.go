@@ -1,25 +1,78 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"html/template"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/pires/nats-sniffer/sniffer"
 )
 
 var (
 	port = flag.Int("port", 8080, "Port to listen to for client requests")
-	nats = flag.String("nats", "localhost:4222", "NATS address (user:pass@host:port) to connect to for sniffing")
+	nats = flag.String("nats", "localhost:4222", "Comma separated NATS servers ([nats|tls]://host:port) to connect to for sniffing")
+
+	natsUser         = flag.String("nats-user", os.Getenv("NATS_USER"), "NATS user (defaults to $NATS_USER)")
+	natsPasswordFile = flag.String("nats-password-file", "", "File holding the NATS password (defaults to $NATS_PASSWORD)")
+	natsTokenFile    = flag.String("nats-token-file", "", "File holding the NATS authentication token (defaults to $NATS_TOKEN)")
+	natsCA           = flag.String("nats-ca", "", "CA certificate used to verify NATS servers")
+	natsCert         = flag.String("nats-cert", "", "Client certificate for mutual TLS with NATS servers")
+	natsKey          = flag.String("nats-key", "", "Client key for mutual TLS with NATS servers")
+
+	historySize  = flag.Int("history-size", sniffer.DefaultHistorySize, "Number of messages kept per subject for late-joining clients")
+	historyBytes = flag.Int("history-bytes", sniffer.DefaultHistoryBytes, "Number of payload bytes kept per subject for late-joining clients")
+	queueSize    = flag.Int("queue-size", sniffer.DefaultQueueSize, "Number of messages buffered for each client")
+	slowConsumer = flag.String("slow-consumer", sniffer.DropOldest.String(), "What to do when a client queue is full (drop-oldest, drop-newest or disconnect)")
+
+	heartbeatInterval = flag.Duration("heartbeat", 15*time.Second, "How often to send heartbeats to idle clients")
+	statsInterval     = flag.Duration("stats-interval", 5*time.Second, "How often to send delivery statistics to clients")
+
+	captureDir        = flag.String("capture-dir", "captures", "Directory capture files recorded over HTTP are written to")
+	captureMaxRunning = flag.Int("capture-max-running", 4, "Number of recordings running at once over HTTP")
+	captureMaxBytes   = flag.Int64("capture-max-bytes", 1<<30, "Number of bytes a recording over HTTP writes at most")
+
+	adminTokenFile = flag.String("admin-token-file", "", "File holding the bearer token of the admin API, which is off without one (defaults to $ADMIN_TOKEN)")
+
+	discover     = flag.Bool("discover", false, "Discover the subjects under -discover-root, serving them at /subjects")
+	discoverRoot = flag.String("discover-root", ">", "Subject to discover the subjects under")
+	discoverMax  = flag.Int("discover-max", sniffer.DefaultMaxSubjects, "Number of subjects to keep track of when discovering")
+
+	correlate      = flag.Bool("correlate", false, "Pair sniffed requests with their responses, subscribing to their reply subjects")
+	requestTimeout = flag.Duration("request-timeout", sniffer.DefaultRequestTimeout, "How long to wait for the response to a sniffed request")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for clients to go away when shutting down")
 )
 
 // Broker handles message delivery to all connected clients
 type Broker struct {
-	sniffer *sniffer.Sniffer
+	sniffer  *sniffer.Sniffer
+	sessions *sessionRegistry
+	quit     chan struct{}
+}
+
+// NewBroker returns a new broker delivering messages sniffed by s.
+func NewBroker(s *sniffer.Sniffer) *Broker {
+	return &Broker{
+		sniffer:  s,
+		sessions: newSessionRegistry(),
+		quit:     make(chan struct{}),
+	}
+}
+
+// Shutdown sends every client a final shutdown event and ends their streams.
+func (b *Broker) Shutdown() {
+	close(b.quit)
 }
 
-// ServeHTTP handles GET /sniff/ URL.
+// ServeHTTP handles GET /sniff/ and /sniff.ndjson URLs.
 func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// make sure that the writer supports flushing.
 	f, ok := w.(http.Flusher)
@@ -28,34 +81,136 @@ func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// set the headers related to event streaming.
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+	// get the subjects and payload filters from query
+	group, err := newSniffGroup(b.sniffer, r.URL.Query()["subject"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filters, err := filtersFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	replays, err := replaysFromRequest(r, len(group.subjects))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, duration, err := limitsFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	withExchanges, err := exchangesFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Printf("Incoming client [%s].\n", group)
 
-	// get the subject from path
-	subject := r.URL.Query().Get("subject")
-	fmt.Printf("Incoming client [%s].\n", subject)
+	var stream messageStream
+	if wantsNDJSON(r) {
+		stream = newNDJSONStream(w, f)
+	} else {
+		stream = newEventStream(w, f, replays)
+	}
 
 	// incoming message handler
-	handlerFn := func(msg string) {
-		fmt.Fprintf(w, "data: %s\n\n", msg)
-		f.Flush()
+	limiter := newLimiter(limit)
+	handlerFn := func(i int, msg *sniffer.SniffedMessage) {
+		if limiter.take() {
+			stream.sendMessage(i, msg)
+		}
 	}
 
-	// sniff
-	handlerId, err := b.sniffer.Sniff(subject, handlerFn)
+	// sniff, failing with a proper status code before the stream begins
+	var filter sniffer.Filter
+	var options []sniffer.SniffOption
+	if len(filters) > 0 {
+		filter = sniffer.All(filters...)
+		options = append(options, sniffer.WithFilter(filter))
+	}
+	err = stream.open(func() error {
+		return group.sniff(handlerFn, replays, options...)
+	})
 	if err != nil {
-		fmt.Fprintf(w, "There was an error while sniffing subject [%s]: %s\n", subject, err.Error())
-		f.Flush()
+		fmt.Printf("Error sniffing subjects [%s]: %s\n", group, err.Error())
+		http.Error(w, err.Error(), sniffStatusCode(err))
 		return
 	}
 
-	// wait until client disconnects
+	// let administrators see who sniffs what
+	session := b.sessions.add(r, func() []string { return group.subjects }, group.stats)
+
+	// let the client know about NATS connection state changes
+	status := b.sniffer.Status()
+	stream.send(statusEvent, &status)
+	watchId := b.sniffer.Watch(func(status *sniffer.ConnectionStatus) {
+		stream.send(statusEvent, status)
+	})
+	defer b.sniffer.Unwatch(watchId)
+
+	// and about requests being answered or not, if asked to
+	var exchanges <-chan *sniffer.Exchange
+	if withExchanges {
+		var unwatch func()
+		exchanges, unwatch = watchExchanges(group, filter)
+		defer unwatch()
+	}
+
+	heartbeats := time.NewTicker(*heartbeatInterval)
+	defer heartbeats.Stop()
+	statsTicks := time.NewTicker(*statsInterval)
+	defer statsTicks.Stop()
+
+	var timeout <-chan time.Time
+	if duration > 0 {
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	// wait until client disconnects, is disconnected for being too slow,
+	// got what it asked for or the service shuts down
 	closing := w.(http.CloseNotifier).CloseNotify()
-	<-closing
-	b.sniffer.Unsniff(subject, handlerId)
-	fmt.Printf("Client gone [%s].\n", subject)
+	done := group.done()
+loop:
+	for {
+		select {
+		case <-limiter.done():
+			break loop
+		case <-timeout:
+			break loop
+		case <-heartbeats.C:
+			stream.heartbeat()
+		case <-statsTicks.C:
+			stream.send(statsEvent, &statsBody{ClientStats: group.stats(), Traffic: group.traffic()})
+		case e := <-exchanges:
+			stream.send(exchangeEvent, e)
+		case <-closing:
+			break loop
+		case <-done:
+			if err := group.err(); err == sniffer.ERR_SLOW_CONSUMER {
+				fmt.Printf("Disconnecting slow client [%s].\n", group)
+				stream.send(errorEvent, &errorBody{Error: err.Error()})
+			} else {
+				stream.send(shutdownEvent, map[string]string{"reason": "Sniffer is shutting down."})
+			}
+			break loop
+		case <-session.killed:
+			stream.send(errorEvent, &errorBody{Error: ERR_SESSION_KILLED.Error()})
+			break loop
+		case <-b.quit:
+			stream.send(shutdownEvent, map[string]string{"reason": "Sniffer is shutting down."})
+			break loop
+		}
+	}
+	b.sessions.remove(session)
+	stats := group.stats()
+	group.unsniff()
+	fmt.Printf("Client gone [%s], delivered %d, dropped %d.\n", group, stats.Delivered, stats.Dropped)
 }
 
 // MainPageHandler renders the main page.
@@ -68,7 +223,7 @@ func MainPageHandler(w http.ResponseWriter, r *http.Request) {
 	// read in the template with our SSE JavaScript code.
 	t, err := template.ParseFiles("templates/index.html")
 	if err != nil {
-		fmt.Errorf("WTF dude, error parsing your template.")
+		http.Error(w, "WTF dude, error parsing your template.", http.StatusInternalServerError)
 		return
 	}
 
@@ -79,25 +234,181 @@ func MainPageHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Finished HTTP request at ", r.URL.Path)
 }
 
+// secret reads a secret from a file or, if no file is given, from an
+// environment variable, so that it doesn't show up in the process list.
+func secret(file string, env string) (string, error) {
+	if file == "" {
+		return os.Getenv(env), nil
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// newSniffer returns a sniffer configured by command-line flags.
+func newSniffer(options ...sniffer.Option) (*sniffer.Sniffer, error) {
+	policy, err := sniffer.ParseSlowConsumerPolicy(*slowConsumer)
+	if err != nil {
+		return nil, err
+	}
+
+	password, err := secret(*natsPasswordFile, "NATS_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	token, err := secret(*natsTokenFile, "NATS_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+
+	defaults := []sniffer.Option{
+		sniffer.WithQueueSize(*queueSize),
+		sniffer.WithSlowConsumerPolicy(policy),
+		sniffer.WithHistory(*historySize, *historyBytes),
+		sniffer.WithUserInfo(*natsUser, password),
+		sniffer.WithToken(token),
+		sniffer.WithTLS(*natsCA, *natsCert, *natsKey),
+	}
+	if *correlate {
+		defaults = append(defaults, sniffer.WithCorrelation(*requestTimeout))
+	}
+	return sniffer.NewSniffer(*nats, append(defaults, options...)...), nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] [serve [flags] | offline [flags] <file>... | proxy [flags] | sniff|record [flags] <subject>... | replay [flags] [<file>...] | pcap [flags] <file>...]\n\n", os.Args[0])
+	fmt.Fprintln(os.Stderr, "  serve   serve sniffed messages over HTTP (default)")
+	fmt.Fprintln(os.Stderr, "  offline serve recorded messages over HTTP, as if they were live")
+	fmt.Fprintln(os.Stderr, "  proxy   serve the NATS operations of proxied clients over HTTP")
+	fmt.Fprintln(os.Stderr, "  sniff   print sniffed messages to stdout")
+	fmt.Fprintln(os.Stderr, "  record  write sniffed messages to capture files")
+	fmt.Fprintln(os.Stderr, "  replay  publish recorded messages again")
+	fmt.Fprintln(os.Stderr, "  pcap    print the NATS operations decoded from packet captures")
+	fmt.Fprintln(os.Stderr, "")
+	flag.PrintDefaults()
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
-	s := sniffer.NewSniffer(*nats)
+	switch command := flag.Arg(0); command {
+	case "":
+		serveMain()
+	case "serve":
+		flag.CommandLine.Parse(flag.Args()[1:])
+		serveMain()
+	case "offline":
+		os.Exit(offlineMain(flag.Args()[1:]))
+	case "proxy":
+		os.Exit(proxyMain(flag.Args()[1:]))
+	case "sniff":
+		os.Exit(sniffMain(flag.Args()[1:]))
+	case "record":
+		os.Exit(recordMain(flag.Args()[1:]))
+	case "replay":
+		os.Exit(replayMain(flag.Args()[1:]))
+	case "pcap":
+		os.Exit(pcapMain(flag.Args()[1:]))
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command [%s].\n", command)
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+}
+
+// serveMain sniffs NATS on behalf of HTTP clients.
+func serveMain() {
+	s, err := newSniffer()
+	if err != nil {
+		panic(err)
+	}
+	serve(s, nil)
+}
+
+// feeder feeds messages to a sniffer created without a NATS connection,
+// e.g. from recordings.
+type feeder interface {
+	// start starts feeding, registering the HTTP handlers controlling it
+	// if any.
+	start() error
+	// stop stops feeding, waiting for messages in flight.
+	stop()
+}
+
+// serve sniffs on behalf of HTTP clients until told to stop. Offline,
+// the feeder, if any, gives the sniffer what to sniff.
+func serve(s *sniffer.Sniffer, f feeder) {
 	if err := s.Start(); err != nil {
 		panic(err)
 	}
 
 	// Make a new Broker instance
-	b := &Broker{sniffer: s}
+	b := NewBroker(s)
 
 	// handlers
 	http.Handle("/sniff/", b)
+	http.Handle("/sniff.ndjson", b)
+	http.HandleFunc("/ws", b.ServeWebSocket)
+	http.HandleFunc("/latency", b.ServeLatency)
+	http.HandleFunc("/stats", b.ServeStats)
+	http.HandleFunc("/stats/", b.ServeStats)
+	http.HandleFunc("/metrics", b.ServeMetrics)
+	adminToken, err := secret(*adminTokenFile, "ADMIN_TOKEN")
+	if err != nil {
+		panic(err)
+	}
+	if adminToken != "" {
+		http.Handle("/admin/", adminHandler(b, adminToken))
+	}
+	captures := newCaptureManager(s, *captureDir, adminToken)
+	http.Handle("/captures", captures)
+	http.Handle("/captures/", captures)
+	if *discover {
+		if err := discoverSubjects(s, *discoverRoot); err != nil {
+			panic(err)
+		}
+	}
+	if f != nil {
+		if err := f.start(); err != nil {
+			panic(err)
+		}
+	}
 	http.Handle("/", http.HandlerFunc(MainPageHandler))
 
-	// wait for Ctrl-c to stop server
-	fmt.Println("Service is running, press CTRL+C or CTRL+Z to quit...")
-	if err := http.ListenAndServe(fmt.Sprint(":", *port), nil); err != nil {
+	server := &http.Server{Addr: fmt.Sprint(":", *port)}
+	serverErrors := make(chan error, 1)
+	go func() {
+		serverErrors <- server.ListenAndServe()
+	}()
+
+	// wait for Ctrl-c or SIGTERM to stop server
+	fmt.Println("Service is running, press CTRL+C to quit...")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serverErrors:
 		panic(err)
+	case sig := <-signals:
+		fmt.Printf("Got %s, shutting down.\n", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	// let clients know, then wait for them to go away
+	b.Shutdown()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Printf("Error shutting down HTTP server: %s\n", err.Error())
+	}
+	captures.stopAll()
+	if f != nil {
+		f.stop()
+	}
+	if err := s.Stop(ctx); err != nil {
+		fmt.Printf("Error stopping sniffer: %s\n", err.Error())
 	}
 
 	fmt.Println("Sniffer terminated.")
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// ndjsonContentType is the media type of newline-delimited JSON.
+const ndjsonContentType = "application/x-ndjson"
+
+// wantsNDJSON tells whether a client asked for newline-delimited JSON,
+// either at /sniff.ndjson or through its Accept header.
+func wantsNDJSON(r *http.Request) bool {
+	return r.URL.Path == "/sniff.ndjson" || strings.Contains(r.Header.Get("Accept"), ndjsonContentType)
+}
+
+// ndjsonStream writes one JSON envelope per line for every sniffed message,
+// so that command-line tools like jq can consume it as is. Other events
+// are left out.
+type ndjsonStream struct {
+	w http.ResponseWriter
+	f http.Flusher
+	// messages sent before the stream begins are held, until it does
+	begun bool
+	held  bytes.Buffer
+	mutex sync.Mutex
+}
+
+func newNDJSONStream(w http.ResponseWriter, f http.Flusher) *ndjsonStream {
+	return &ndjsonStream{
+		w: w,
+		f: f,
+	}
+}
+
+// open calls start and, if it succeeds, begins the stream. The lock isn't
+// held while start runs, so that handlers it starts can send messages, or
+// be stopped should start fail.
+func (ns *ndjsonStream) open(start func() error) error {
+	if err := start(); err != nil {
+		return err
+	}
+
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	ns.w.Header().Set("Content-Type", ndjsonContentType)
+	ns.w.Header().Set("Cache-Control", "no-cache")
+	ns.w.WriteHeader(http.StatusOK)
+	ns.held.WriteTo(ns.w)
+	ns.begun = true
+	ns.f.Flush()
+
+	return nil
+}
+
+// sendMessage writes a sniffed message on its own line, or holds it until
+// the stream begins.
+func (ns *ndjsonStream) sendMessage(i int, msg *sniffer.SniffedMessage) {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+
+	var w io.Writer = ns.w
+	if !ns.begun {
+		w = &ns.held
+	}
+	if err := json.NewEncoder(w).Encode(msg); err != nil {
+		fmt.Printf("Error encoding message: %s\n", err.Error())
+		return
+	}
+	if ns.begun {
+		ns.f.Flush()
+	}
+}
+
+// send drops anything but messages.
+func (ns *ndjsonStream) send(event string, v interface{}) {}
+
+// heartbeat does nothing, as anything but messages would get in the way
+// of consumers.
+func (ns *ndjsonStream) heartbeat() {}
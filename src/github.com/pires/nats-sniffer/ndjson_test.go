@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+func TestNDJSONStream(t *testing.T) {
+	s, b, srv := runBroker(t)
+	defer stopBroker(s, b, srv)
+
+	for _, test := range []struct {
+		path   string
+		accept string
+	}{
+		{"/sniff.ndjson", ""},
+		{"/sniff/", ndjsonContentType},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+test.path+"?subject=device.>&limit=2", nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != ndjsonContentType {
+			t.Fatalf("%s: expected %s, got %s", test.path, ndjsonContentType, ct)
+		}
+
+		// nothing but messages, one per line, until the limit
+		for _, payload := range []string{`{"a":1}`, "two", "three"} {
+			s.Inject(&sniffer.SniffedMessage{Subject: "device.a", Data: []byte(payload), Size: len(payload), Timestamp: time.Now()})
+		}
+		r := bufio.NewReader(resp.Body)
+		for _, payload := range []string{`{"a":1}`, "two"} {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				t.Fatalf("%s: %v", test.path, err)
+			}
+			var msg map[string]interface{}
+			if err := json.Unmarshal(line, &msg); err != nil || msg["payload"] != payload {
+				t.Errorf("%s: expected %s on its own line, got %q", test.path, payload, line)
+			}
+		}
+		if rest, err := ioutil.ReadAll(r); err != nil || len(rest) > 0 {
+			t.Errorf("%s: expected the stream to end after the limit, got %q %v", test.path, rest, err)
+		}
+		resp.Body.Close()
+	}
+}
+
+func TestNDJSONStreamDuration(t *testing.T) {
+	s, b, srv := runBroker(t)
+	defer stopBroker(s, b, srv)
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	start := time.Now()
+	resp, err := client.Get(srv.URL + "/sniff.ndjson?subject=device.>&duration=200ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || len(body) > 0 {
+		t.Errorf("Expected an empty stream, got %q %v", body, err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("Expected the stream to end after 200ms, took %v", elapsed)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// offlineMain runs the offline command, which serves messages recorded to
+// capture files or message dumps as if they were being sniffed live, and
+// returns its exit code.
+func offlineMain(args []string) int {
+	fs := flag.NewFlagSet("offline", flag.ContinueOnError)
+	addGlobalFlags(fs, servingFlags)
+	addGlobalFlags(fs, sniffingFlags)
+	speed := fs.Float64("speed", 1, "Multiplier of the original pace of messages, e.g. 2 for twice as fast")
+	play := fs.Bool("play", false, "Start playing right away instead of waiting for a client to ask for it")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s offline [flags] <file>...\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Files are capture files or message dumps, possibly gzipped, played back in the order messages were recorded.")
+		fs.PrintDefaults()
+	}
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(files) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	messages, err := readRecordings(files)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitFailure
+	}
+
+	s, err := newSniffer(sniffer.WithoutConn())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+	playback := sniffer.NewPlayback(messages, s.Inject)
+	if err := playback.SetSpeed(*speed); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+	if *play {
+		playback.Play()
+	}
+
+	state := playback.State()
+	fmt.Printf("Loaded %d messages recorded from %s to %s.\n", state.Total,
+		state.Start.Format(time.RFC3339Nano), state.End.Format(time.RFC3339Nano))
+	serve(s, &playbackHandler{playback: playback})
+	return exitMessages
+}
+
+// readRecordings reads every message recorded to several files, in the
+// order they were recorded.
+func readRecordings(files []string) ([]*sniffer.SniffedMessage, error) {
+	readers := make([]sniffer.MessageReader, 0, len(files))
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r, err := sniffer.NewMessageReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading [%s]: %s", file, err.Error())
+		}
+		readers = append(readers, r)
+	}
+	return sniffer.ReadMessages(readers...)
+}
+
+// playbackHandler lets HTTP clients control an offline playback:
+//
+//	GET /playback                   describes the playback
+//	POST /playback                  changes it, taking any of:
+//
+//	speed=<multiplier>              play at a multiple of the original pace
+//	seek=<time>                     move to an RFC 3339 time, or a duration into the recording, e.g. 90s
+//	action=play|pause               resume or stop playing
+//
+// Both reply with the playback state.
+type playbackHandler struct {
+	playback *sniffer.Playback
+}
+
+func (h *playbackHandler) start() error {
+	http.Handle("/playback", h)
+	h.playback.Start()
+	return nil
+}
+
+func (h *playbackHandler) stop() {
+	h.playback.Stop()
+}
+
+// ServeHTTP handles the /playback URL.
+func (h *playbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := h.change(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, h.playback.State())
+}
+
+// change applies the changes asked for, once they're all known to be
+// valid.
+func (h *playbackHandler) change(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	speed := 0.0
+	if value := r.Form.Get("speed"); value != "" {
+		var err error
+		speed, err = strconv.ParseFloat(value, 64)
+		if err != nil || speed <= 0 {
+			return fmt.Errorf("Invalid speed [%s]: expected a positive multiplier, e.g. 2", value)
+		}
+	}
+	var seek time.Time
+	if value := r.Form.Get("seek"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			seek = h.playback.State().Start.Add(d)
+		} else if seek, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return fmt.Errorf("Invalid seek [%s]: expected an RFC 3339 time or a duration, e.g. 90s", value)
+		}
+	}
+	action := r.Form.Get("action")
+	if action != "" && action != "play" && action != "pause" {
+		return fmt.Errorf("Unknown action [%s].", action)
+	}
+
+	if speed > 0 {
+		h.playback.SetSpeed(speed)
+	}
+	if !seek.IsZero() {
+		h.playback.Seek(seek)
+	}
+	switch action {
+	case "play":
+		h.playback.Play()
+	case "pause":
+		h.playback.Pause()
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// writeRecordings writes a gzipped capture file holding the even messages
+// of a recording, and a message dump holding the odd ones.
+func writeRecordings(t *testing.T, dir string, messages []*sniffer.SniffedMessage) []string {
+	capture, err := os.Create(filepath.Join(dir, "even.ncap.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer capture.Close()
+	gz := gzip.NewWriter(capture)
+	cw, err := sniffer.NewCaptureWriter(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump, err := os.Create(filepath.Join(dir, "odd.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dump.Close()
+	dw := sniffer.NewDumpWriter(dump)
+
+	for i, msg := range messages {
+		if i%2 == 0 {
+			err = cw.Write(msg)
+		} else {
+			err = dw.Write(msg)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return []string{capture.Name(), dump.Name()}
+}
+
+func TestOfflinePlayback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recordings")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Unix(1456826400, 0)
+	var recorded []*sniffer.SniffedMessage
+	for i := 0; i < 4; i++ {
+		payload := strconv.Itoa(i)
+		recorded = append(recorded, &sniffer.SniffedMessage{
+			Subject:   "device.a",
+			Data:      []byte(payload),
+			Size:      len(payload),
+			Timestamp: start.Add(time.Duration(i) * 100 * time.Millisecond),
+		})
+	}
+	messages, err := readRecordings(writeRecordings(t, dir, recorded))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, b, srv := runBroker(t)
+	defer stopBroker(s, b, srv)
+	playback := sniffer.NewPlayback(messages, s.Inject)
+	playback.Start()
+	defer playback.Stop()
+	control := httptest.NewServer(&playbackHandler{playback: playback})
+	defer control.Close()
+
+	resp, err := http.Get(srv.URL + "/sniff.ndjson?subject=device.>&limit=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// the recording lasts 300ms, played twice as fast
+	played := time.Now()
+	controlResp, err := http.PostForm(control.URL+"/playback", url.Values{"speed": {"2"}, "action": {"play"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state sniffer.PlaybackState
+	json.NewDecoder(controlResp.Body).Decode(&state)
+	controlResp.Body.Close()
+	if !state.Playing || state.Speed != 2 || state.Total != 4 || !state.Start.Equal(start) {
+		t.Errorf("Unexpected playback state: %+v", state)
+	}
+
+	// messages of both files come interleaved, in the order they were
+	// recorded
+	r := bufio.NewReader(resp.Body)
+	for i := 0; i < 4; i++ {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var msg map[string]interface{}
+		if err := json.Unmarshal(line, &msg); err != nil || msg["payload"] != strconv.Itoa(i) {
+			t.Fatalf("Expected message %d, got %q", i, line)
+		}
+	}
+	if elapsed := time.Since(played); elapsed < 140*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected the recording to be played in 150ms, took %v", elapsed)
+	}
+}
+
+func TestPlaybackHandler(t *testing.T) {
+	start := time.Unix(1456826400, 0)
+	playback := sniffer.NewPlayback([]*sniffer.SniffedMessage{
+		{Subject: "a", Timestamp: start},
+		{Subject: "b", Timestamp: start.Add(time.Minute)},
+	}, func(msg *sniffer.SniffedMessage) {})
+	playback.Start()
+	defer playback.Stop()
+	control := httptest.NewServer(&playbackHandler{playback: playback})
+	defer control.Close()
+
+	for _, test := range []struct {
+		form url.Values
+		code int
+	}{
+		{url.Values{"speed": {"0"}}, http.StatusBadRequest},
+		{url.Values{"seek": {"yesterday"}}, http.StatusBadRequest},
+		{url.Values{"action": {"rewind"}}, http.StatusBadRequest},
+		{url.Values{"seek": {"30s"}}, http.StatusOK},
+	} {
+		resp, err := http.PostForm(control.URL+"/playback", test.form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("Expected %d for %v, got %d", test.code, test.form, resp.StatusCode)
+		}
+	}
+	if state := playback.State(); state.Played != 1 || !state.Position.Equal(start.Add(30*time.Second)) || state.Playing {
+		t.Errorf("Expected a paused playback 30s in, got %+v", state)
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, control.URL+"/playback", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected %d, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
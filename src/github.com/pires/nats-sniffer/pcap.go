@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// pcapMain runs the pcap command, which prints the NATS operations decoded
+// from packet captures, and returns its exit code.
+func pcapMain(args []string) int {
+	fs := flag.NewFlagSet("pcap", flag.ContinueOnError)
+	q := url.Values{}
+	addFilterFlags(fs, q)
+	fs.Var(&queryFlag{q: q, name: "subject"}, "subject", "Only keep messages whose subject matches a pattern, e.g. device.> or _NATS.connect")
+	natsPort := fs.Int("nats-port", sniffer.DefaultNATSPort, "Port NATS servers listen to in the capture")
+	format := fs.String("format", lineFormat, "Output format (line, raw, json, hex, dump or template)")
+	tmpl := fs.String("template", "", "Go text/template to print every message with, e.g. '{{.Op}} {{.Subject}}'")
+	color := fs.String("color", "auto", "Colorize subjects (auto, always or never)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s pcap [flags] <file>...\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Files are pcap or pcapng captures, e.g. written by tcpdump, possibly gzipped. - reads stdin.")
+		fs.PrintDefaults()
+	}
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(files) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	filter, err := recordedFilter(q)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+	colorize, err := useColor(*color)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+	p, err := newPrinter(os.Stdout, *format, *tmpl, colorize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+
+	printed := 0
+	code := exitMessages
+	for _, file := range files {
+		n, err := printPcap(file, *natsPort, filter, p)
+		printed += n
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error decoding [%s]: %s\n", file, err.Error())
+			code = exitFailure
+			break
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "%d messages printed.\n", printed)
+	if code == exitMessages && printed == 0 {
+		code = exitNoMessages
+	}
+	return code
+}
+
+// printPcap prints the operations decoded from a capture file, or stdin
+// for -, and returns how many were printed.
+func printPcap(file string, port int, filter sniffer.Filter, p *printer) (int, error) {
+	var f io.Reader = os.Stdin
+	if file != "-" {
+		opened, err := os.Open(file)
+		if err != nil {
+			return 0, err
+		}
+		defer opened.Close()
+		f = opened
+	}
+
+	r, err := sniffer.NewPcapReader(f, port)
+	if err != nil {
+		return 0, err
+	}
+	printed := 0
+	for {
+		msg, err := r.Read()
+		if err == io.EOF {
+			return printed, nil
+		}
+		if err != nil {
+			return printed, err
+		}
+		if filter != nil && !filter.Match(msg) {
+			continue
+		}
+		if err := p.print(msg); err != nil {
+			return printed, err
+		}
+		printed++
+	}
+}
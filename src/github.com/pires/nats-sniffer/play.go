@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// rewriteFlag collects repeated old=new subject prefix rewrites.
+type rewriteFlag map[string]string
+
+func (f rewriteFlag) String() string {
+	var rewrites []string
+	for prefix, replacement := range f {
+		rewrites = append(rewrites, prefix+"="+replacement)
+	}
+	return strings.Join(rewrites, ",")
+}
+
+func (f rewriteFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected <prefix>=<replacement>, e.g. prod.=staging.")
+	}
+	f[value[:i]] = value[i+1:]
+	return nil
+}
+
+// timeFlag is an optional RFC 3339 timestamp.
+type timeFlag struct {
+	t *time.Time
+}
+
+func (f timeFlag) String() string {
+	if f.t == nil || f.t.IsZero() {
+		return ""
+	}
+	return f.t.Format(time.RFC3339Nano)
+}
+
+func (f timeFlag) Set(value string) error {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return fmt.Errorf("expected an RFC 3339 timestamp, e.g. 2016-03-01T10:00:00Z")
+	}
+	*f.t = t
+	return nil
+}
+
+// replayMain runs the replay command, which publishes messages recorded
+// to capture files or message dumps again, and returns its exit code.
+func replayMain(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	addGlobalFlags(fs, connectionFlags)
+	q := url.Values{}
+	addFilterFlags(fs, q)
+	fs.Var(&queryFlag{q: q, name: "subject"}, "subject", "Only keep messages whose subject matches a pattern, e.g. device.>")
+	player := sniffer.NewPlayer()
+	player.Rewrite = make(map[string]string)
+	fs.Var(rewriteFlag(player.Rewrite), "rewrite", "Replace a subject prefix, e.g. prod.=staging.")
+	fs.Var(timeFlag{&player.From}, "from", "Only keep messages recorded at or after this time (RFC 3339)")
+	fs.Var(timeFlag{&player.To}, "to", "Only keep messages recorded at or before this time (RFC 3339)")
+	fs.Float64Var(&player.Speed, "speed", 1, "Multiplier of the original pace of messages, e.g. 2 for twice as fast")
+	fast := fs.Bool("fast", false, "Publish as fast as possible")
+	fs.Float64Var(&player.MaxRate, "max-rate", 0, "Publish at most this many messages per second")
+	dryRun := fs.Bool("dry-run", false, "Print what would be published, right away, instead of publishing it")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [flags] [<file>...]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Files are capture files or message dumps, possibly gzipped, and default to stdin.")
+		fs.PrintDefaults()
+	}
+	files, err := parseArgs(fs, args)
+	if err != nil {
+		return exitUsage
+	}
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	if player.Speed < 0 || player.MaxRate < 0 {
+		fmt.Fprintln(os.Stderr, "Speed and rate can't be negative.")
+		return exitUsage
+	}
+	if *fast || *dryRun {
+		player.Speed = 0
+	}
+	if *dryRun {
+		player.MaxRate = 0
+	}
+
+	player.Filter, err = recordedFilter(q)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+
+	// publish, or print what would be published
+	var publish func(msg *sniffer.SniffedMessage) error
+	if *dryRun {
+		colorize, _ := useColor("auto")
+		p, _ := newPrinter(os.Stdout, lineFormat, "", colorize)
+		publish = p.print
+	} else {
+		s, err := newSniffer()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return exitUsage
+		}
+		nc, err := s.Dial()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error connecting to NATS: %s\n", err.Error())
+			return exitFailure
+		}
+		defer func() {
+			nc.Flush()
+			nc.Close()
+		}()
+		publish = sniffer.Publisher(nc)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	played := 0
+	code := exitMessages
+	for _, file := range files {
+		n, err := replayFile(ctx, player, file, publish)
+		played += n
+		if err == context.Canceled {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error replaying [%s]: %s\n", file, err.Error())
+			code = exitFailure
+			break
+		}
+	}
+
+	if *dryRun {
+		fmt.Fprintf(os.Stderr, "%d messages would be published.\n", played)
+	} else {
+		fmt.Fprintf(os.Stderr, "%d messages published.\n", played)
+	}
+	if code == exitMessages && played == 0 {
+		code = exitNoMessages
+	}
+	return code
+}
+
+// recordedFilter builds the filter selecting recorded messages out of
+// the filter and subject flags, if any.
+func recordedFilter(q url.Values) (sniffer.Filter, error) {
+	filters, err := filtersFromQuery(q)
+	if err != nil {
+		return nil, err
+	}
+	if patterns := q["subject"]; len(patterns) > 0 {
+		f, err := sniffer.Subjects(patterns...)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 0 {
+		return nil, nil
+	}
+	return sniffer.All(filters...), nil
+}
+
+// replayFile plays the messages recorded to a file, or stdin for -.
+func replayFile(ctx context.Context, player *sniffer.Player, file string, publish func(msg *sniffer.SniffedMessage) error) (int, error) {
+	var f io.Reader = os.Stdin
+	if file != "-" {
+		opened, err := os.Open(file)
+		if err != nil {
+			return 0, err
+		}
+		defer opened.Close()
+		f = opened
+	}
+
+	r, err := sniffer.NewMessageReader(f)
+	if err != nil {
+		return 0, err
+	}
+	return player.Play(ctx, r, publish)
+}
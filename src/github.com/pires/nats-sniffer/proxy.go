@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// proxyFeeder feeds a sniffer with the operations of NATS clients going
+// through a proxy.
+type proxyFeeder struct {
+	proxy  *sniffer.Proxy
+	listen string
+}
+
+func (f *proxyFeeder) start() error {
+	l, err := net.Listen("tcp", f.listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := f.proxy.Serve(l); err != nil {
+			fmt.Printf("Error proxying NATS clients: %s\n", err.Error())
+		}
+	}()
+	return nil
+}
+
+func (f *proxyFeeder) stop() {
+	f.proxy.Close()
+}
+
+// proxyMain runs the proxy command, which serves the operations of NATS
+// clients connecting through it to a NATS server, and returns its exit
+// code.
+func proxyMain(args []string) int {
+	fs := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	addGlobalFlags(fs, servingFlags)
+	addGlobalFlags(fs, sniffingFlags)
+	listen := fs.String("listen", ":4223", "Address to listen to for NATS clients")
+	upstream := fs.String("upstream", "localhost:4222", "NATS server (host:port) to forward clients to")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s proxy [flags]\n", os.Args[0])
+		fmt.Fprintln(os.Stderr, "Clients connect to the proxy instead of the NATS server. TLS traffic is forwarded but not decoded.")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	s, err := newSniffer(sniffer.WithoutConn())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return exitUsage
+	}
+
+	fmt.Printf("Proxying NATS clients from [%s] to [%s].\n", *listen, *upstream)
+	serve(s, &proxyFeeder{proxy: sniffer.NewProxy(*upstream, s.Inject), listen: *listen})
+	return exitMessages
+}
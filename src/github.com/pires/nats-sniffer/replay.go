@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// replaysFromRequest builds the replay of recent messages requested by a
+// client sniffing n subjects:
+//
+//	history=<count>      the last count messages of every subject
+//	since=<duration>     messages younger than duration, e.g. 5m
+//
+// A Last-Event-ID header, sent by browsers when reconnecting, resumes every
+// subject right after the message sequence it holds for it instead, so
+// nothing is missed.
+func replaysFromRequest(r *http.Request, n int) ([]sniffer.Replay, error) {
+	replays := make([]sniffer.Replay, n)
+
+	if lastEventId := r.Header.Get("Last-Event-ID"); lastEventId != "" {
+		sequences := strings.Split(lastEventId, ",")
+		if len(sequences) != n {
+			return nil, fmt.Errorf("Invalid Last-Event-ID [%s]: expected %d message sequences", lastEventId, n)
+		}
+		for i, sequence := range sequences {
+			after, err := strconv.ParseUint(sequence, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid Last-Event-ID [%s]: expected message sequences", lastEventId)
+			}
+			replays[i] = sniffer.Replay{Resume: true, After: after}
+		}
+		return replays, nil
+	}
+
+	var replay sniffer.Replay
+	if history := r.URL.Query().Get("history"); history != "" {
+		count, err := strconv.Atoi(history)
+		if err != nil || count < 0 {
+			return nil, fmt.Errorf("Invalid history [%s]: expected a number of messages", history)
+		}
+		replay.Count = count
+	}
+	if since := r.URL.Query().Get("since"); since != "" {
+		d, err := time.ParseDuration(since)
+		if err != nil || d < 0 {
+			return nil, fmt.Errorf("Invalid since [%s]: expected a duration, e.g. 5m", since)
+		}
+		replay.Since = d
+	}
+	for i := range replays {
+		replays[i] = replay
+	}
+
+	return replays, nil
+}
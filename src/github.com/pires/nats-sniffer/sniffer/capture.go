@@ -0,0 +1,204 @@
+package sniffer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"time"
+)
+
+var (
+	ERR_INVALID_CAPTURE     = errors.New("Not a capture file.")
+	ERR_UNSUPPORTED_CAPTURE = errors.New("Unsupported capture file version.")
+	ERR_CORRUPT_CAPTURE     = errors.New("Corrupt capture record.")
+	ERR_RECORD_TOO_BIG      = errors.New("Message is too big to be captured.")
+)
+
+// CaptureVersion is the version of the capture file format written.
+const CaptureVersion = 1
+
+// maxRecordSize bounds records, well above the biggest payload NATS allows,
+// 64MB, along with its subjects, so that a corrupt length doesn't make
+// readers allocate gigabytes.
+const maxRecordSize = 80 << 20
+
+// captureMagic starts every capture file, followed by the format version.
+var captureMagic = []byte("NATSCAP")
+
+// gzipMagic starts gzip compressed files.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// A capture file is a header followed by records, appended as messages
+// arrive, all integers being big endian:
+//
+//	header:  "NATSCAP" | version (1 byte)
+//	record:  length of what follows (uint32)
+//	         timestamp in nanoseconds since the Unix epoch (int64)
+//	         subject length (uint16) | subject
+//	         reply length (uint16) | reply
+//	         server ID length (uint16) | server ID
+//	         payload length (uint32) | payload
+//
+// Records are at most maxRecordSize bytes. Readers skip whatever follows
+// the known fields of a record, so that writers of this version may add
+// some. Files of later versions are refused, as they may change more than
+// that. A whole file may be gzip compressed.
+
+// CaptureWriter appends sniffed messages to a capture file.
+type CaptureWriter struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+// NewCaptureWriter writes a capture file header to w and returns a writer
+// for its records.
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	header := append(append([]byte{}, captureMagic...), CaptureVersion)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &CaptureWriter{w: w}, nil
+}
+
+// Write appends a message to the capture file. Every record is written at
+// once, so that a crash leaves at most the last one truncated.
+func (cw *CaptureWriter) Write(msg *SniffedMessage) error {
+	length := 8 + 2 + len(msg.Subject) + 2 + len(msg.Reply) + 2 + len(msg.ServerID) + 4 + len(msg.Data)
+	if len(msg.Subject) > math.MaxUint16 || len(msg.Reply) > math.MaxUint16 ||
+		len(msg.ServerID) > math.MaxUint16 || length > maxRecordSize {
+		return ERR_RECORD_TOO_BIG
+	}
+
+	cw.buf.Reset()
+	cw.buf.Grow(4 + length)
+	var n [8]byte
+	binary.BigEndian.PutUint32(n[:4], uint32(length))
+	cw.buf.Write(n[:4])
+	binary.BigEndian.PutUint64(n[:], uint64(msg.Timestamp.UnixNano()))
+	cw.buf.Write(n[:])
+	for _, s := range []string{msg.Subject, msg.Reply, msg.ServerID} {
+		binary.BigEndian.PutUint16(n[:2], uint16(len(s)))
+		cw.buf.Write(n[:2])
+		cw.buf.WriteString(s)
+	}
+	binary.BigEndian.PutUint32(n[:4], uint32(len(msg.Data)))
+	cw.buf.Write(n[:4])
+	cw.buf.Write(msg.Data)
+
+	_, err := cw.w.Write(cw.buf.Bytes())
+	return err
+}
+
+// CaptureReader reads sniffed messages back from a capture file.
+type CaptureReader struct {
+	r       *bufio.Reader
+	version byte
+}
+
+// NewCaptureReader reads a capture file header from r, which may be gzip
+// compressed, and returns a reader for its records.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	return newCaptureReader(br)
+}
+
+func newCaptureReader(br *bufio.Reader) (*CaptureReader, error) {
+	header := make([]byte, len(captureMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, ERR_INVALID_CAPTURE
+	}
+	if !bytes.Equal(header[:len(captureMagic)], captureMagic) {
+		return nil, ERR_INVALID_CAPTURE
+	}
+	version := header[len(captureMagic)]
+	if version == 0 || version > CaptureVersion {
+		return nil, ERR_UNSUPPORTED_CAPTURE
+	}
+
+	return &CaptureReader{r: br, version: version}, nil
+}
+
+// Version returns the format version of the capture file.
+func (cr *CaptureReader) Version() int {
+	return int(cr.version)
+}
+
+// Read returns the next message of the capture file, or io.EOF once there
+// are no more. A truncated last record, e.g. left by a crash, yields
+// io.ErrUnexpectedEOF, and one claiming more than maxRecordSize bytes
+// ERR_CORRUPT_CAPTURE.
+func (cr *CaptureReader) Read() (*SniffedMessage, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(cr.r, n[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(n[:])
+	if length > maxRecordSize {
+		return nil, ERR_CORRUPT_CAPTURE
+	}
+	record := make([]byte, length)
+	if _, err := io.ReadFull(cr.r, record); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	d := recordDecoder{b: record}
+	msg := &SniffedMessage{}
+	msg.Timestamp = time.Unix(0, int64(d.uint64()))
+	msg.Subject = string(d.bytes(int(d.uint16())))
+	msg.Reply = string(d.bytes(int(d.uint16())))
+	msg.ServerID = string(d.bytes(int(d.uint16())))
+	msg.Data = d.bytes(int(d.uint32()))
+	msg.Size = len(msg.Data)
+	if d.err {
+		return nil, ERR_CORRUPT_CAPTURE
+	}
+
+	return msg, nil
+}
+
+// recordDecoder reads the fields of a record, remembering whether it ran
+// short.
+type recordDecoder struct {
+	b   []byte
+	err bool
+}
+
+func (d *recordDecoder) bytes(n int) []byte {
+	if d.err || n > len(d.b) {
+		d.err = true
+		return nil
+	}
+	b := d.b[:n:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *recordDecoder) uint16() uint16 {
+	if b := d.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *recordDecoder) uint32() uint32 {
+	if b := d.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *recordDecoder) uint64() uint64 {
+	if b := d.bytes(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
@@ -0,0 +1,233 @@
+package sniffer
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultQueueSize is the default number of messages buffered per client.
+const DefaultQueueSize = 1024
+
+// SlowConsumerPolicy tells what to do when a client queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// DropOldest discards the oldest queued message to make room.
+	DropOldest SlowConsumerPolicy = iota
+	// DropNewest discards the incoming message.
+	DropNewest
+	// Disconnect drops the incoming message and disconnects the client.
+	Disconnect
+)
+
+var slowConsumerPolicyNames = map[SlowConsumerPolicy]string{
+	DropOldest: "drop-oldest",
+	DropNewest: "drop-newest",
+	Disconnect: "disconnect",
+}
+
+func (p SlowConsumerPolicy) String() string {
+	if name, ok := slowConsumerPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("SlowConsumerPolicy(%d)", int(p))
+}
+
+// ParseSlowConsumerPolicy returns the policy with the given name, one of
+// drop-oldest, drop-newest or disconnect.
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	for p, n := range slowConsumerPolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown slow consumer policy [%s].", name)
+}
+
+// ClientStats holds delivery counters of a single sniff client.
+type ClientStats struct {
+	Delivered uint64             `json:"delivered"`
+	Dropped   uint64             `json:"dropped"`
+	Filtered  uint64             `json:"filtered"`
+	Pending   int                `json:"pending"`
+	Policy    SlowConsumerPolicy `json:"-"`
+}
+
+// deliveryTotals adds up the delivery counters of clients, including gone
+// ones.
+type deliveryTotals struct {
+	// accessed atomically
+	delivered uint64
+	dropped   uint64
+}
+
+// client owns a bounded queue of messages and a goroutine that feeds them
+// to a handler, so that one slow handler doesn't hold back the others.
+type client struct {
+	// accessed atomically
+	delivered uint64
+	dropped   uint64
+	filtered  uint64
+
+	// totals, if set, adds up the counters of every client
+	totals *deliveryTotals
+
+	handler   SniffedMessageHandler
+	policy    SlowConsumerPolicy
+	filter    Filter
+	queue     chan *SniffedMessage
+	backlog   []*SniffedMessage
+	ready     chan struct{}
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	// err tells why the client stopped, if it was disconnected
+	err error
+	// serializes enqueue so drop-oldest can make room safely
+	mutex sync.Mutex
+}
+
+// newClient creates a client and starts its writer goroutine, which waits
+// for begin to be called. Only messages matching filter, if any, are
+// delivered to handler.
+func newClient(handler SniffedMessageHandler, queueSize int, policy SlowConsumerPolicy, filter Filter) *client {
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	c := &client{
+		handler: handler,
+		policy:  policy,
+		filter:  filter,
+		queue:   make(chan *SniffedMessage, queueSize),
+		ready:   make(chan struct{}),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+func (c *client) run() {
+	defer close(c.done)
+
+	select {
+	case <-c.quit:
+		return
+	case <-c.ready:
+	}
+
+	for _, msg := range c.backlog {
+		select {
+		case <-c.quit:
+			return
+		default:
+		}
+		c.deliver(msg)
+	}
+	c.backlog = nil
+
+	for {
+		select {
+		case <-c.quit:
+			return
+		case msg := <-c.queue:
+			// quit wins over pending messages
+			select {
+			case <-c.quit:
+				return
+			default:
+			}
+			c.deliver(msg)
+		}
+	}
+}
+
+// begin starts delivering messages, backlog ones first.
+func (c *client) begin(backlog []*SniffedMessage) {
+	c.backlog = backlog
+	close(c.ready)
+}
+
+// deliver calls the handler with a message, unless it's filtered out.
+func (c *client) deliver(msg *SniffedMessage) {
+	// filters run here rather than when queueing, so that
+	// expensive ones don't hold back other clients
+	if c.filter != nil && !c.filter.Match(msg) {
+		atomic.AddUint64(&c.filtered, 1)
+		return
+	}
+	c.handler(msg)
+	atomic.AddUint64(&c.delivered, 1)
+	if c.totals != nil {
+		atomic.AddUint64(&c.totals.delivered, 1)
+	}
+}
+
+// enqueue queues a message for delivery without ever blocking.
+func (c *client) enqueue(msg *SniffedMessage) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	select {
+	case <-c.quit:
+		return
+	default:
+	}
+
+	select {
+	case c.queue <- msg:
+		return
+	default:
+	}
+
+	// queue is full
+	atomic.AddUint64(&c.dropped, 1)
+	if c.totals != nil {
+		atomic.AddUint64(&c.totals.dropped, 1)
+	}
+	switch c.policy {
+	case DropOldest:
+		select {
+		case <-c.queue:
+		default:
+		}
+		select {
+		case c.queue <- msg:
+		default:
+		}
+	case Disconnect:
+		c.closeOnce.Do(func() {
+			c.err = ERR_SLOW_CONSUMER
+			close(c.quit)
+		})
+	}
+}
+
+// stop stops the client and waits until no handler call is in flight.
+func (c *client) stop() {
+	c.closeOnce.Do(func() { close(c.quit) })
+	<-c.done
+}
+
+// Done returns a channel that's closed once the client stops receiving messages.
+func (c *client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the client was disconnected, once it's done.
+func (c *client) Err() error {
+	<-c.done
+	return c.err
+}
+
+// Stats returns a snapshot of the client delivery counters.
+func (c *client) Stats() ClientStats {
+	return ClientStats{
+		Delivered: atomic.LoadUint64(&c.delivered),
+		Dropped:   atomic.LoadUint64(&c.dropped),
+		Filtered:  atomic.LoadUint64(&c.filtered),
+		Pending:   len(c.queue),
+		Policy:    c.policy,
+	}
+}
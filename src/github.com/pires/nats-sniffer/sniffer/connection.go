@@ -0,0 +1,249 @@
+package sniffer
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats"
+)
+
+// Reconnecting happens in two stages, which together never give up and
+// back off. The NATS client first reconnects on its own, keeping its
+// subscriptions, but it only waits a fixed reconnectWait between attempts
+// and can't back off. So rather than letting it retry forever, it gives up
+// after maxReconnects attempts per server, about 20 seconds of quick
+// retries covering server restarts and rolling upgrades. The sniffer then
+// creates new connections with exponential backoff, forever, subscribing
+// again everything being sniffed once one succeeds. The second stage also
+// covers connections closed for any other reason.
+const (
+	// reconnectWait is how long the NATS client waits before reconnecting
+	// to a server it was connected to.
+	reconnectWait = 2 * time.Second
+	// maxReconnects is the number of times the NATS client tries every
+	// server before giving up and closing the connection.
+	maxReconnects = 10
+	// minRecoveryWait and maxRecoveryWait bound the exponential backoff
+	// used to create a new connection once the NATS client gave up.
+	minRecoveryWait = time.Second
+	maxRecoveryWait = 30 * time.Second
+)
+
+var (
+	ERR_NO_SERVERS         = errors.New("No NATS servers to connect to.")
+	ERR_CONFLICTING_AUTH   = errors.New("Use either a token or user credentials, not both.")
+	ERR_INCOMPLETE_TLS     = errors.New("Both a client certificate and key are needed for mutual TLS.")
+	ERR_PASSWORD_NO_USER   = errors.New("A password was given without a user.")
+	ERR_UNSUPPORTED_SCHEME = errors.New("NATS URLs must use the nats:// or tls:// scheme.")
+)
+
+// connect creates a new NATS connection, reporting its state changes to
+// watchers and recovering it whenever the NATS client gives up.
+func (s *Sniffer) connect() error {
+	opts, err := s.natsOptions()
+	if err != nil {
+		return err
+	}
+	opts.MaxReconnect = maxReconnects
+	opts.ReconnectWait = reconnectWait
+	opts.DisconnectedCB = func(nc *nats.Conn) {
+		s.statuses.set(&ConnectionStatus{State: Disconnected, Error: errorString(nc.LastError())})
+	}
+	opts.ReconnectedCB = func(nc *nats.Conn) {
+		s.statuses.set(&ConnectionStatus{State: Reconnected, Server: connectedServer(nc)})
+	}
+	opts.ClosedCB = s.closed
+
+	nc, err := opts.Connect()
+	if err != nil {
+		return err
+	}
+
+	s.connMutex.Lock()
+	s.natsConn = nc
+	s.connMutex.Unlock()
+	s.statuses.set(&ConnectionStatus{State: Connected, Server: connectedServer(nc)})
+
+	return nil
+}
+
+// Dial opens a NATS connection configured like the sniffer's own, e.g. to
+// publish messages. It's up to the caller to close it, and it isn't
+// recovered once the NATS client gives up.
+func (s *Sniffer) Dial() (*nats.Conn, error) {
+	opts, err := s.natsOptions()
+	if err != nil {
+		return nil, err
+	}
+	return opts.Connect()
+}
+
+// closed handles a closed NATS connection. Unless the sniffer is quitting,
+// a new connection is created in the background.
+func (s *Sniffer) closed(nc *nats.Conn) {
+	if nc != s.conn() {
+		return
+	}
+	s.statuses.set(&ConnectionStatus{State: Closed, Error: errorString(nc.LastError())})
+
+	select {
+	case <-s.Quit:
+	default:
+		go s.recover()
+	}
+}
+
+// recover creates a new NATS connection, with exponential backoff between
+// attempts, and subscribes again everything being sniffed.
+func (s *Sniffer) recover() {
+	wait := minRecoveryWait
+	var lastErr error
+	for attempt := 1; ; attempt++ {
+		s.statuses.set(&ConnectionStatus{State: Reconnecting, Attempt: attempt, Error: errorString(lastErr)})
+
+		select {
+		case <-s.Quit:
+			return
+		case <-time.After(wait):
+		}
+
+		if lastErr = s.connect(); lastErr == nil {
+			select {
+			case <-s.Quit:
+				// stopped while connecting
+				s.conn().Close()
+				return
+			default:
+			}
+			if err := s.registry.resubscribe(); err != nil {
+				fmt.Printf("Error subscribing again: %s\n", err.Error())
+			}
+			if err := s.rediscover(s.conn()); err != nil {
+				fmt.Printf("Error discovering subjects again: %s\n", err.Error())
+			}
+			if s.correlator != nil {
+				if err := s.correlator.watchInboxes(s.conn()); err != nil {
+					fmt.Printf("Error subscribing to inboxes again: %s\n", err.Error())
+				}
+			}
+			return
+		}
+
+		wait *= 2
+		if wait > maxRecoveryWait {
+			wait = maxRecoveryWait
+		}
+	}
+}
+
+// conn returns the current NATS connection.
+func (s *Sniffer) conn() *nats.Conn {
+	s.connMutex.RLock()
+	defer s.connMutex.RUnlock()
+	return s.natsConn
+}
+
+// connectedServer returns the URL of the server nc is connected to,
+// without credentials.
+func connectedServer(nc *nats.Conn) string {
+	u, err := url.Parse(nc.ConnectedUrl())
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	return u.String()
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// natsOptions builds the options used to connect to NATS out of the
+// sniffer configuration.
+func (s *Sniffer) natsOptions() (nats.Options, error) {
+	opts := nats.DefaultOptions
+
+	servers, err := s.servers()
+	if err != nil {
+		return opts, err
+	}
+	opts.Servers = servers
+
+	// configure internal buffered chan; the default is 64k and
+	// we end up using too much memory because of that;
+	opts.SubChanLen = 8192
+
+	if s.CAFile != "" {
+		if err := nats.RootCAs(s.CAFile)(&opts); err != nil {
+			return opts, err
+		}
+	}
+	if s.CertFile != "" || s.KeyFile != "" {
+		if s.CertFile == "" || s.KeyFile == "" {
+			return opts, ERR_INCOMPLETE_TLS
+		}
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return opts, fmt.Errorf("Error loading client certificate: %s", err.Error())
+		}
+		if opts.TLSConfig == nil {
+			opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		opts.TLSConfig.Certificates = []tls.Certificate{cert}
+		opts.Secure = true
+	}
+
+	return opts, nil
+}
+
+// servers parses the comma separated list of NATS URLs the sniffer was
+// created with. URLs without a scheme default to nats://. Credentials not
+// present in a URL are taken from the sniffer configuration.
+func (s *Sniffer) servers() ([]string, error) {
+	if s.Token != "" && (s.User != "" || s.Password != "") {
+		return nil, ERR_CONFLICTING_AUTH
+	}
+	if s.Password != "" && s.User == "" {
+		return nil, ERR_PASSWORD_NO_USER
+	}
+
+	var servers []string
+	for _, server := range strings.Split(s.natsURL, ",") {
+		server = strings.TrimSpace(server)
+		if server == "" {
+			continue
+		}
+		if !strings.Contains(server, "://") {
+			server = "nats://" + server
+		}
+
+		u, err := url.Parse(server)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "nats" && u.Scheme != "tls" {
+			return nil, ERR_UNSUPPORTED_SCHEME
+		}
+		if u.User == nil {
+			switch {
+			case s.Token != "":
+				u.User = url.User(s.Token)
+			case s.User != "":
+				u.User = url.UserPassword(s.User, s.Password)
+			}
+		}
+		servers = append(servers, u.String())
+	}
+
+	if len(servers) == 0 {
+		return nil, ERR_NO_SERVERS
+	}
+	return servers, nil
+}
@@ -0,0 +1,343 @@
+package sniffer
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats"
+	"github.com/satori/go.uuid"
+)
+
+const (
+	// DefaultRequestTimeout is how long to wait for the response to a
+	// request by default.
+	DefaultRequestTimeout = 5 * time.Second
+	// maxPendingRequests bounds the requests waiting for a response, so
+	// that a flood of requests doesn't flood NATS with subscriptions.
+	maxPendingRequests = 10000
+	// latencySamples is the number of latest latencies per subject that
+	// percentiles are computed from.
+	latencySamples = 1000
+	// inboxPrefix starts the reply inboxes NATS clients create.
+	inboxPrefix = "_INBOX."
+)
+
+// Exchange is a request along with its response, or lack thereof.
+type Exchange struct {
+	Request  *SniffedMessage `json:"request"`
+	Response *SniffedMessage `json:"response,omitempty"`
+	// Latency is how long the response took, in nanoseconds.
+	Latency  time.Duration `json:"latency_ns,omitempty"`
+	TimedOut bool          `json:"timed_out,omitempty"`
+}
+
+// ExchangeHandler is called for every request, once answered or timed out.
+type ExchangeHandler func(e *Exchange)
+
+// LatencyStats describes the requests sent to a subject. Percentiles and
+// maximum are computed from the latest responses, in nanoseconds.
+type LatencyStats struct {
+	Requests  uint64        `json:"requests"`
+	Responses uint64        `json:"responses"`
+	Timeouts  uint64        `json:"timeouts"`
+	P50       time.Duration `json:"p50_ns"`
+	P90       time.Duration `json:"p90_ns"`
+	P99       time.Duration `json:"p99_ns"`
+	Max       time.Duration `json:"max_ns"`
+}
+
+// correlator pairs sniffed requests with their responses. Responses to
+// _INBOX. inboxes, which NATS clients create, are all received through a
+// single subscription, so that even the fastest responders are caught.
+// As they may then be received before their request, they're held until
+// it is, or for as long as a request would wait. Other reply subjects are
+// subscribed for every request, until it's answered or times out, and
+// responders answering before then go unnoticed.
+type correlator struct {
+	timeout time.Duration
+	pending map[string]*pendingRequest
+	// early holds responses to inboxes no request was seen for yet
+	early map[string]*earlyResponse
+	// inboxes receives the responses to every _INBOX. inbox
+	inboxes  *nats.Subscription
+	subjects map[string]*latencyRecorder
+	watchers map[string]ExchangeHandler
+	mutex    sync.RWMutex
+}
+
+// pendingRequest is a request waiting for its response. Requests to
+// _INBOX. inboxes have no subscription of their own.
+type pendingRequest struct {
+	request      *SniffedMessage
+	subscription *nats.Subscription
+	timer        *time.Timer
+}
+
+// earlyResponse is a response waiting for its request.
+type earlyResponse struct {
+	response *SniffedMessage
+	timer    *time.Timer
+}
+
+// latencyRecorder keeps the counters and latest latencies of a subject.
+type latencyRecorder struct {
+	stats     LatencyStats
+	latencies []time.Duration
+	next      int
+}
+
+func newCorrelator(timeout time.Duration) *correlator {
+	return &correlator{
+		timeout:  timeout,
+		pending:  make(map[string]*pendingRequest),
+		early:    make(map[string]*earlyResponse),
+		subjects: make(map[string]*latencyRecorder),
+		watchers: make(map[string]ExchangeHandler),
+	}
+}
+
+// watchInboxes subscribes to every _INBOX. inbox on nc, e.g. once
+// connected again.
+func (c *correlator) watchInboxes(nc *nats.Conn) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.inboxes != nil {
+		c.inboxes.Unsubscribe()
+	}
+	subscription, err := nc.Subscribe(inboxPrefix+fullWildcard, func(m *nats.Msg) {
+		c.respond(responseMessage(nc, m))
+	})
+	if err != nil {
+		return err
+	}
+	c.inboxes = subscription
+	return nil
+}
+
+// track waits for the response to a request received on nc.
+func (c *correlator) track(nc *nats.Conn, request *SniffedMessage) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.pending[request.Reply]; ok || len(c.pending) >= maxPendingRequests {
+		return
+	}
+	inbox := request.Reply
+	p := &pendingRequest{request: request}
+	if !strings.HasPrefix(inbox, inboxPrefix) {
+		subscription, err := nc.Subscribe(inbox, func(m *nats.Msg) {
+			c.resolve(inbox, responseMessage(nc, m))
+		})
+		if err != nil {
+			return
+		}
+		subscription.AutoUnsubscribe(1)
+		p.subscription = subscription
+	}
+
+	c.recorder(request.Subject).stats.Requests++
+	c.pending[inbox] = p
+	p.timer = time.AfterFunc(c.timeout, func() {
+		c.resolve(inbox, nil)
+	})
+
+	// answered already
+	if early, ok := c.early[inbox]; ok {
+		delete(c.early, inbox)
+		early.timer.Stop()
+		go c.resolve(inbox, early.response)
+	}
+}
+
+// respond pairs a response to an _INBOX. inbox with its request, or holds
+// it until the request is received.
+func (c *correlator) respond(response *SniffedMessage) {
+	inbox := response.Subject
+	c.mutex.Lock()
+	if _, ok := c.pending[inbox]; ok {
+		c.mutex.Unlock()
+		c.resolve(inbox, response)
+		return
+	}
+	defer c.mutex.Unlock()
+
+	if _, ok := c.early[inbox]; ok || len(c.early) >= maxPendingRequests {
+		return
+	}
+	c.early[inbox] = &earlyResponse{
+		response: response,
+		timer: time.AfterFunc(c.timeout, func() {
+			c.mutex.Lock()
+			defer c.mutex.Unlock()
+			delete(c.early, inbox)
+		}),
+	}
+}
+
+// responseMessage wraps a response received on nc.
+func responseMessage(nc *nats.Conn, m *nats.Msg) *SniffedMessage {
+	return &SniffedMessage{
+		Subject:   m.Subject,
+		Reply:     m.Reply,
+		Data:      m.Data,
+		Size:      len(m.Data),
+		Timestamp: time.Now(),
+		ServerID:  nc.ConnectedServerId(),
+	}
+}
+
+// resolve pairs a pending request with its response, nil meaning it timed
+// out, and lets watchers know.
+func (c *correlator) resolve(inbox string, response *SniffedMessage) {
+	c.mutex.Lock()
+	p, ok := c.pending[inbox]
+	if !ok {
+		c.mutex.Unlock()
+		return
+	}
+	delete(c.pending, inbox)
+	p.timer.Stop()
+	if p.subscription != nil {
+		p.subscription.Unsubscribe()
+	}
+
+	e := &Exchange{Request: p.request, Response: response}
+	r := c.recorder(p.request.Subject)
+	if response == nil {
+		e.TimedOut = true
+		r.stats.Timeouts++
+	} else {
+		// responses received before their request took no time, as far
+		// as the sniffer can tell
+		e.Latency = response.Timestamp.Sub(p.request.Timestamp)
+		if e.Latency < 0 {
+			e.Latency = 0
+		}
+		r.stats.Responses++
+		r.add(e.Latency)
+	}
+	c.mutex.Unlock()
+
+	// watchers can't go away while being called
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	for _, handler := range c.watchers {
+		handler(e)
+	}
+}
+
+// recorder returns the latency recorder of a subject, creating it if
+// needed. The lock is assumed to be held upon entering.
+func (c *correlator) recorder(subject string) *latencyRecorder {
+	r, ok := c.subjects[subject]
+	if !ok {
+		r = &latencyRecorder{}
+		c.subjects[subject] = r
+	}
+	return r
+}
+
+// clear gives up on every pending request, and stops receiving responses.
+func (c *correlator) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for inbox, p := range c.pending {
+		p.timer.Stop()
+		if p.subscription != nil {
+			p.subscription.Unsubscribe()
+		}
+		delete(c.pending, inbox)
+	}
+	for inbox, early := range c.early {
+		early.timer.Stop()
+		delete(c.early, inbox)
+	}
+	if c.inboxes != nil {
+		c.inboxes.Unsubscribe()
+		c.inboxes = nil
+	}
+}
+
+// add records a latency, evicting the oldest one past latencySamples.
+func (r *latencyRecorder) add(latency time.Duration) {
+	if len(r.latencies) < latencySamples {
+		r.latencies = append(r.latencies, latency)
+		return
+	}
+	r.latencies[r.next] = latency
+	r.next = (r.next + 1) % latencySamples
+}
+
+// snapshot returns the counters along with percentiles of the latest
+// latencies.
+func (r *latencyRecorder) snapshot() LatencyStats {
+	stats := r.stats
+	if len(r.latencies) == 0 {
+		return stats
+	}
+	sorted := append([]time.Duration(nil), r.latencies...)
+	sort.Sort(byDuration(sorted))
+	percentile := func(p int) time.Duration {
+		return sorted[(len(sorted)-1)*p/100]
+	}
+	stats.P50 = percentile(50)
+	stats.P90 = percentile(90)
+	stats.P99 = percentile(99)
+	stats.Max = sorted[len(sorted)-1]
+	return stats
+}
+
+type byDuration []time.Duration
+
+func (b byDuration) Len() int           { return len(b) }
+func (b byDuration) Less(i, j int) bool { return b[i] < b[j] }
+func (b byDuration) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// WatchExchanges registers a handler to be called for every request
+// sniffed, once it's answered or times out, when the sniffer was created
+// WithCorrelation. Handlers must not block. It returns an id to be passed
+// to UnwatchExchanges.
+func (s *Sniffer) WatchExchanges(handler ExchangeHandler) string {
+	id := uuid.NewV4().String()
+	if s.correlator == nil {
+		return id
+	}
+
+	s.correlator.mutex.Lock()
+	defer s.correlator.mutex.Unlock()
+	s.correlator.watchers[id] = handler
+
+	return id
+}
+
+// UnwatchExchanges removes an exchange handler. Once UnwatchExchanges
+// returns, the handler won't be called again.
+func (s *Sniffer) UnwatchExchanges(id string) {
+	if s.correlator == nil {
+		return
+	}
+
+	s.correlator.mutex.Lock()
+	defer s.correlator.mutex.Unlock()
+	delete(s.correlator.watchers, id)
+}
+
+// LatencyStats returns the request counters and latencies of every subject
+// requests were sniffed on, when the sniffer was created WithCorrelation.
+func (s *Sniffer) LatencyStats() map[string]LatencyStats {
+	stats := make(map[string]LatencyStats)
+	if s.correlator == nil {
+		return stats
+	}
+
+	s.correlator.mutex.RLock()
+	defer s.correlator.mutex.RUnlock()
+	for subject, r := range s.correlator.subjects {
+		stats[subject] = r.snapshot()
+	}
+	return stats
+}
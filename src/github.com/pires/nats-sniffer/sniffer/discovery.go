@@ -0,0 +1,267 @@
+package sniffer
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats"
+)
+
+// DefaultMaxSubjects is the default number of subjects a subject tree
+// keeps track of, so that unique subjects like reply inboxes don't use up
+// memory.
+const DefaultMaxSubjects = 100000
+
+// SubjectTree discovers subjects out of the messages added to it, keeping
+// a tree of their tokens, e.g. device, device.abc and device.abc.connection
+// for a message of device.abc.connection. Every node counts the messages
+// of its subject and of the subjects below it.
+type SubjectTree struct {
+	root     *subjectNode
+	nodes    int
+	maxNodes int
+	mutex    sync.RWMutex
+}
+
+// subjectNode is a token of the subject tree.
+type subjectNode struct {
+	children  map[string]*subjectNode
+	firstSeen time.Time
+	lastSeen  time.Time
+	messages  uint64
+	bytes     uint64
+}
+
+// SubjectNode describes a node of a subject tree, as of when it was asked
+// for.
+type SubjectNode struct {
+	Token string `json:"token"`
+	// Subject is the subject of the node, empty for the root.
+	Subject string `json:"subject"`
+	// Pattern matches the subjects below the node, e.g. device.abc.> for a
+	// node with children, and is the subject itself otherwise. Like any
+	// NATS pattern ending with >, it doesn't match the subject of the node,
+	// which takes sniffing both.
+	Pattern   string    `json:"pattern"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Messages  uint64    `json:"messages"`
+	Bytes     uint64    `json:"bytes"`
+	// Subjects is the number of nodes below this one.
+	Subjects int            `json:"subjects"`
+	Children []*SubjectNode `json:"children,omitempty"`
+}
+
+// NewSubjectTree returns an empty tree keeping track of up to maxSubjects
+// subjects, DefaultMaxSubjects if not positive. Past it, messages of new
+// subjects are counted by their closest known parent.
+func NewSubjectTree(maxSubjects int) *SubjectTree {
+	if maxSubjects <= 0 {
+		maxSubjects = DefaultMaxSubjects
+	}
+	return &SubjectTree{
+		root:     newSubjectNode(),
+		maxNodes: maxSubjects,
+	}
+}
+
+func newSubjectNode() *subjectNode {
+	return &subjectNode{children: make(map[string]*subjectNode)}
+}
+
+// Add counts a message in the nodes of its subject, creating them if
+// needed. It's a SniffedMessageHandler, so that a tree can discover the
+// subjects under a sniffed one, though Discover is meant for that.
+func (t *SubjectTree) Add(msg *SniffedMessage) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	n := t.root
+	n.seen(msg)
+	for _, token := range strings.Split(msg.Subject, tokenSeparator) {
+		child, ok := n.children[token]
+		if !ok {
+			if t.nodes >= t.maxNodes {
+				return
+			}
+			child = newSubjectNode()
+			n.children[token] = child
+			t.nodes++
+		}
+		child.seen(msg)
+		n = child
+	}
+}
+
+func (n *subjectNode) seen(msg *SniffedMessage) {
+	if n.messages == 0 {
+		n.firstSeen = msg.Timestamp
+	}
+	n.lastSeen = msg.Timestamp
+	n.messages++
+	n.bytes += uint64(msg.Size)
+}
+
+// Node describes the node of subject, the root if empty, along with its
+// children down to depth levels, every level if not positive. It returns
+// false if no message of the subject, or below it, was seen.
+func (t *SubjectTree) Node(subject string, depth int) (*SubjectNode, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	n := t.root
+	token := ""
+	if subject != "" {
+		for _, token = range strings.Split(subject, tokenSeparator) {
+			child, ok := n.children[token]
+			if !ok {
+				return nil, false
+			}
+			n = child
+		}
+	}
+	return n.describe(token, subject, depth), true
+}
+
+// describe describes a node and its children, down to depth levels.
+func (n *subjectNode) describe(token string, subject string, depth int) *SubjectNode {
+	node := &SubjectNode{
+		Token:     token,
+		Subject:   subject,
+		Pattern:   subject,
+		FirstSeen: n.firstSeen,
+		LastSeen:  n.lastSeen,
+		Messages:  n.messages,
+		Bytes:     n.bytes,
+	}
+	if len(n.children) > 0 {
+		if subject == "" {
+			node.Pattern = fullWildcard
+		} else {
+			node.Pattern = subject + tokenSeparator + fullWildcard
+		}
+	}
+
+	if depth == 1 {
+		node.Subjects = n.count()
+		return node
+	}
+
+	tokens := make([]string, 0, len(n.children))
+	for token := range n.children {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	for _, token := range tokens {
+		childSubject := token
+		if subject != "" {
+			childSubject = subject + tokenSeparator + token
+		}
+		child := n.children[token].describe(token, childSubject, depth-1)
+		node.Subjects += 1 + child.Subjects
+		node.Children = append(node.Children, child)
+	}
+	return node
+}
+
+// count returns the number of nodes below a node.
+func (n *subjectNode) count() int {
+	count := len(n.children)
+	for _, child := range n.children {
+		count += child.count()
+	}
+	return count
+}
+
+// discovery feeds a subject tree with the messages of a subject.
+type discovery struct {
+	subject      string
+	tree         *SubjectTree
+	subscription *nats.Subscription
+}
+
+// subscribe subscribes the discovery on nc, e.g. once connected again.
+func (d *discovery) subscribe(nc *nats.Conn) error {
+	if d.subscription != nil {
+		d.subscription.Unsubscribe()
+	}
+	subscription, err := nc.Subscribe(d.subject, func(m *nats.Msg) {
+		d.tree.Add(&SniffedMessage{
+			Subject:   m.Subject,
+			Size:      len(m.Data),
+			Timestamp: time.Now(),
+		})
+	})
+	if err != nil {
+		return err
+	}
+	d.subscription = subscription
+	return nil
+}
+
+// Discover feeds tree with every message of subject, injected ones
+// included. Unlike sniffing, it subscribes on its own: discovering > doesn't
+// merge the subscriptions of sniffed subjects into a single one, nor does it
+// show in their history, traffic statistics or metrics. Messages coming
+// faster than the tree takes them are dropped by the NATS client.
+func (s *Sniffer) Discover(subject string, tree *SubjectTree) error {
+	if !ValidSubject(subject) {
+		return ERR_INVALID_SUBJECT
+	}
+
+	s.discoveryMutex.Lock()
+	defer s.discoveryMutex.Unlock()
+
+	d := &discovery{subject: subject, tree: tree}
+	if !s.offline {
+		nc := s.conn()
+		if nc == nil || nc.IsClosed() {
+			return ERR_NATS_CONN_CLOSED
+		}
+		if err := d.subscribe(nc); err != nil {
+			return err
+		}
+	}
+	s.discoveries = append(s.discoveries, d)
+	return nil
+}
+
+// rediscover subscribes every discovery again on nc.
+func (s *Sniffer) rediscover(nc *nats.Conn) error {
+	s.discoveryMutex.Lock()
+	defer s.discoveryMutex.Unlock()
+
+	for _, d := range s.discoveries {
+		if err := d.subscribe(nc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discover adds an injected message to the trees discovering its subject.
+func (s *Sniffer) discover(msg *SniffedMessage) {
+	s.discoveryMutex.Lock()
+	defer s.discoveryMutex.Unlock()
+
+	for _, d := range s.discoveries {
+		if SubjectCovers(d.subject, msg.Subject) {
+			d.tree.Add(msg)
+		}
+	}
+}
+
+// undiscover unsubscribes every discovery.
+func (s *Sniffer) undiscover() {
+	s.discoveryMutex.Lock()
+	defer s.discoveryMutex.Unlock()
+
+	for _, d := range s.discoveries {
+		if d.subscription != nil {
+			d.subscription.Unsubscribe()
+		}
+	}
+	s.discoveries = nil
+}
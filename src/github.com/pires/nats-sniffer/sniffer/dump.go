@@ -0,0 +1,123 @@
+package sniffer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+var ERR_NOT_A_DUMP = errors.New("Not a message dump record: message envelopes can't be read back.")
+
+// MessageReader reads recorded messages back, one at a time, returning
+// io.EOF once there are no more.
+type MessageReader interface {
+	Read() (*SniffedMessage, error)
+}
+
+// dumpRecord is a line of a message dump.
+type dumpRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Subject   string    `json:"subject"`
+	Reply     string    `json:"reply,omitempty"`
+	// Payload is base64 encoded, as payloads needn't be text. Its key
+	// differs from the text payload of envelopes, so that they aren't
+	// mistaken for dumps.
+	Payload  []byte `json:"payload_base64"`
+	ServerID string `json:"server_id,omitempty"`
+	Op       string `json:"op,omitempty"`
+	Conn     string `json:"conn,omitempty"`
+	// Envelope is only set when reading an envelope, which is refused.
+	Envelope json.RawMessage `json:"payload,omitempty"`
+}
+
+// A message dump is newline-delimited JSON, one message per line, e.g.
+//
+//	{"timestamp":"2016-03-01T10:00:00.123456789Z","subject":"device.abc.connection","payload_base64":"Q09OTkVDVEVE"}
+//
+// Unlike capture files, dumps are easy to write and edit by hand.
+
+// DumpWriter writes sniffed messages to a message dump.
+type DumpWriter struct {
+	enc *json.Encoder
+}
+
+// NewDumpWriter returns a writer appending messages to w.
+func NewDumpWriter(w io.Writer) *DumpWriter {
+	return &DumpWriter{enc: json.NewEncoder(w)}
+}
+
+// Write appends a message to the dump.
+func (dw *DumpWriter) Write(msg *SniffedMessage) error {
+	return dw.enc.Encode(&dumpRecord{
+		Timestamp: msg.Timestamp,
+		Subject:   msg.Subject,
+		Reply:     msg.Reply,
+		Payload:   msg.Data,
+		ServerID:  msg.ServerID,
+		Op:        msg.Op,
+		Conn:      msg.Conn,
+	})
+}
+
+// DumpReader reads sniffed messages back from a message dump.
+type DumpReader struct {
+	dec *json.Decoder
+}
+
+// NewDumpReader returns a reader for the messages dumped to r.
+func NewDumpReader(r io.Reader) *DumpReader {
+	return &DumpReader{dec: json.NewDecoder(r)}
+}
+
+// Read returns the next message of the dump, or io.EOF once there are no
+// more. Message envelopes, e.g. saved off /sniff.ndjson, are refused with
+// ERR_NOT_A_DUMP.
+func (dr *DumpReader) Read() (*SniffedMessage, error) {
+	var record dumpRecord
+	if err := dr.dec.Decode(&record); err != nil {
+		return nil, err
+	}
+	if record.Envelope != nil {
+		return nil, ERR_NOT_A_DUMP
+	}
+	return &SniffedMessage{
+		Subject:   record.Subject,
+		Reply:     record.Reply,
+		Data:      record.Payload,
+		Size:      len(record.Payload),
+		Timestamp: record.Timestamp,
+		ServerID:  record.ServerID,
+		Op:        record.Op,
+		Conn:      record.Conn,
+	}, nil
+}
+
+// NewMessageReader returns a reader for a capture file or a message dump,
+// telling them apart by their contents. Both may be gzip compressed.
+func NewMessageReader(r io.Reader) (MessageReader, error) {
+	br, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	if magic, err := br.Peek(len(captureMagic)); err == nil && bytes.Equal(magic, captureMagic) {
+		return newCaptureReader(br)
+	}
+	return NewDumpReader(br), nil
+}
+
+// decompress returns a reader for r, decompressing it if it's gzipped.
+func decompress(r io.Reader) (*bufio.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReader(zr)
+	}
+	return br, nil
+}
@@ -0,0 +1,217 @@
+package sniffer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Filter decides whether a sniffed message is delivered to a client.
+type Filter interface {
+	Match(msg *SniffedMessage) bool
+}
+
+// FilterFunc adapts a function to the Filter interface.
+type FilterFunc func(msg *SniffedMessage) bool
+
+// Match calls f(msg).
+func (f FilterFunc) Match(msg *SniffedMessage) bool {
+	return f(msg)
+}
+
+// All returns a filter matching messages that match every given filter.
+func All(filters ...Filter) Filter {
+	return FilterFunc(func(msg *SniffedMessage) bool {
+		for _, f := range filters {
+			if !f.Match(msg) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Contains returns a filter matching payloads that contain substr.
+func Contains(substr string) Filter {
+	b := []byte(substr)
+	return FilterFunc(func(msg *SniffedMessage) bool {
+		return bytes.Contains(msg.Data, b)
+	})
+}
+
+// Regexp returns a filter matching payloads that match a regular expression.
+func Regexp(expr string) (Filter, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid regular expression [%s]: %s", expr, err.Error())
+	}
+	return FilterFunc(func(msg *SniffedMessage) bool {
+		return re.Match(msg.Data)
+	}), nil
+}
+
+// Subjects returns a filter matching messages whose subject matches any of
+// the given patterns, e.g. device.>.
+func Subjects(patterns ...string) (Filter, error) {
+	for _, pattern := range patterns {
+		if !ValidSubject(pattern) {
+			return nil, fmt.Errorf("Invalid subject pattern [%s].", pattern)
+		}
+	}
+	return FilterFunc(func(msg *SniffedMessage) bool {
+		for _, pattern := range patterns {
+			if SubjectCovers(pattern, msg.Subject) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// Exclude returns a filter matching messages whose subject matches none of
+// the given patterns, e.g. device.*.heartbeat.
+func Exclude(patterns ...string) (Filter, error) {
+	for _, pattern := range patterns {
+		if !ValidSubject(pattern) {
+			return nil, fmt.Errorf("Invalid exclude pattern [%s].", pattern)
+		}
+	}
+	return FilterFunc(func(msg *SniffedMessage) bool {
+		for _, pattern := range patterns {
+			if SubjectCovers(pattern, msg.Subject) {
+				return false
+			}
+		}
+		return true
+	}), nil
+}
+
+// SizeRange returns a filter matching payloads of at least min and at most
+// max bytes. A negative bound is ignored.
+func SizeRange(min int, max int) (Filter, error) {
+	if min >= 0 && max >= 0 && min > max {
+		return nil, fmt.Errorf("Invalid size range: minimum %d is greater than maximum %d", min, max)
+	}
+	return FilterFunc(func(msg *SniffedMessage) bool {
+		return (min < 0 || msg.Size >= min) && (max < 0 || msg.Size <= max)
+	}), nil
+}
+
+// jsonOperators are tried in order at every position, so that e.g. >=
+// wins over >.
+var jsonOperators = []string{"!=", ">=", "<=", "=", ">", "<"}
+
+// JSONField returns a filter comparing a field of JSON payloads with a
+// value, e.g. device.firmware=1.0.0 or device.battery<20. The field is a
+// dot separated path, where numbers index arrays. Supported operators are
+// =, !=, >, >=, < and <=. Values are compared as numbers when both sides
+// are numbers, and as strings otherwise. Payloads that aren't JSON or lack
+// the field never match.
+func JSONField(expr string) (Filter, error) {
+	// the field ends at the first operator
+	var path, op, value string
+	for i := 1; i < len(expr) && op == ""; i++ {
+		for _, candidate := range jsonOperators {
+			if strings.HasPrefix(expr[i:], candidate) {
+				path, op, value = expr[:i], candidate, expr[i+len(candidate):]
+				break
+			}
+		}
+	}
+	if op == "" {
+		return nil, fmt.Errorf("Invalid JSON field filter [%s]: expected <field><operator><value>", expr)
+	}
+	keys := strings.Split(path, ".")
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("Invalid JSON field filter [%s]: empty field name", expr)
+		}
+	}
+	number, numberErr := strconv.ParseFloat(value, 64)
+
+	return FilterFunc(func(msg *SniffedMessage) bool {
+		var doc interface{}
+		if err := json.Unmarshal(msg.Data, &doc); err != nil {
+			return false
+		}
+		field, ok := lookup(doc, keys)
+		if !ok {
+			return false
+		}
+
+		var cmp int
+		if f, isNumber := field.(float64); isNumber && numberErr == nil {
+			cmp = compareFloats(f, number)
+		} else {
+			cmp = strings.Compare(fieldString(field), value)
+		}
+
+		switch op {
+		case "=":
+			return cmp == 0
+		case "!=":
+			return cmp != 0
+		case ">":
+			return cmp > 0
+		case ">=":
+			return cmp >= 0
+		case "<":
+			return cmp < 0
+		default:
+			return cmp <= 0
+		}
+	}), nil
+}
+
+// lookup walks a decoded JSON document down a path of keys.
+func lookup(doc interface{}, keys []string) (interface{}, bool) {
+	for _, key := range keys {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			field, ok := v[key]
+			if !ok {
+				return nil, false
+			}
+			doc = field
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// fieldString renders a decoded JSON value for string comparison.
+func fieldString(field interface{}) string {
+	switch v := field.(type) {
+	case string:
+		return v
+	case nil:
+		return "null"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+func compareFloats(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
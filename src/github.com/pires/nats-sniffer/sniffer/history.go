@@ -0,0 +1,106 @@
+package sniffer
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHistorySize is the default number of messages kept per
+	// sniffed subject for late-joining clients.
+	DefaultHistorySize = 100
+	// DefaultHistoryBytes is the default number of payload bytes kept per
+	// sniffed subject for late-joining clients.
+	DefaultHistoryBytes = 1 << 20
+)
+
+// Replay selects past messages of a sniffed subject to be delivered to a
+// new client before live ones.
+type Replay struct {
+	// Count limits replay to the last Count messages, if positive.
+	Count int
+	// Since limits replay to messages younger than Since, if positive.
+	Since time.Duration
+	// Resume replays every message with a sequence greater than After,
+	// e.g. for a client reconnecting after receiving message After.
+	// Count and Since are ignored when resuming, so nothing is missed.
+	Resume bool
+	After  uint64
+}
+
+// enabled tells whether r selects any message at all.
+func (r Replay) enabled() bool {
+	return r.Count > 0 || r.Since > 0 || r.Resume
+}
+
+// history is a ring buffer of the latest messages of a sniffed subject,
+// bounded both by number of messages and payload bytes.
+type history struct {
+	messages []*SniffedMessage
+	bytes    int
+	maxCount int
+	maxBytes int
+	mutex    sync.Mutex
+}
+
+func newHistory(maxCount int, maxBytes int) *history {
+	return &history{
+		maxCount: maxCount,
+		maxBytes: maxBytes,
+	}
+}
+
+// add records a message, evicting the oldest ones to stay within bounds.
+func (h *history) add(msg *SniffedMessage) {
+	if h.maxCount <= 0 || h.maxBytes <= 0 {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.messages = append(h.messages, msg)
+	h.bytes += msg.Size
+	for len(h.messages) > h.maxCount || (h.bytes > h.maxBytes && len(h.messages) > 0) {
+		h.bytes -= h.messages[0].Size
+		h.messages[0] = nil
+		h.messages = h.messages[1:]
+	}
+}
+
+// replay returns copies of the messages selected by r, oldest first,
+// marked as historical.
+func (h *history) replay(r Replay) []*SniffedMessage {
+	if !r.enabled() {
+		return nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	start := 0
+	switch {
+	case r.Resume:
+		for start < len(h.messages) && h.messages[start].Sequence <= r.After {
+			start++
+		}
+	default:
+		if r.Since > 0 {
+			oldest := time.Now().Add(-r.Since)
+			for start < len(h.messages) && h.messages[start].Timestamp.Before(oldest) {
+				start++
+			}
+		}
+		if r.Count > 0 && len(h.messages)-start > r.Count {
+			start = len(h.messages) - r.Count
+		}
+	}
+
+	replayed := make([]*SniffedMessage, 0, len(h.messages)-start)
+	for _, msg := range h.messages[start:] {
+		m := *msg
+		m.Historical = true
+		replayed = append(replayed, &m)
+	}
+	return replayed
+}
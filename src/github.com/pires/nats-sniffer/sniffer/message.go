@@ -0,0 +1,85 @@
+package sniffer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+	"unicode/utf8"
+)
+
+// SniffedMessage is the envelope delivered to sniff clients. It carries the
+// payload together with the metadata NATS handed us when it arrived.
+type SniffedMessage struct {
+	// Subject is the concrete subject the message was published to, which
+	// may differ from the sniffed subject when wildcards are used.
+	Subject string
+	// Reply is the reply inbox, if any.
+	Reply string
+	// Data is the raw message payload.
+	Data []byte
+	// Size is the payload size in bytes.
+	Size int
+	// Timestamp is the moment the sniffer received the message.
+	Timestamp time.Time
+	// Sequence is a per sniffed subject message counter, starting at 1.
+	Sequence uint64
+	// ServerID is the ID of the NATS server we were connected to.
+	ServerID string
+	// Historical is set on messages replayed from history.
+	Historical bool
+	// Op is the NATS protocol operation the message was decoded from, e.g.
+	// PUB or SUB, when sniffing the protocol rather than subscribing.
+	Op string
+	// Conn identifies the client connection the operation belongs to.
+	Conn string
+}
+
+// Envelope is the JSON rendering of a message, as sent to sniff clients.
+type Envelope struct {
+	Subject string `json:"subject"`
+	Reply   string `json:"reply,omitempty"`
+	// Payload is the payload as text, or base64 encoded if it isn't valid
+	// UTF-8, as told by Encoding. Embedders may set it to a
+	// json.RawMessage, e.g. to indent JSON payloads.
+	Payload    interface{} `json:"payload"`
+	Encoding   string      `json:"encoding,omitempty"`
+	Size       int         `json:"size"`
+	Timestamp  time.Time   `json:"timestamp"`
+	Sequence   uint64      `json:"sequence"`
+	ServerID   string      `json:"server_id"`
+	Historical bool        `json:"historical,omitempty"`
+	Op         string      `json:"op,omitempty"`
+	Conn       string      `json:"conn,omitempty"`
+}
+
+// Base64Encoding is the Encoding of envelopes whose payload is base64
+// encoded.
+const Base64Encoding = "base64"
+
+// Envelope returns the JSON rendering of the message. Binary payloads
+// would be mangled as JSON strings, so they're base64 encoded.
+func (m *SniffedMessage) Envelope() *Envelope {
+	e := &Envelope{
+		Subject:    m.Subject,
+		Reply:      m.Reply,
+		Payload:    string(m.Data),
+		Size:       m.Size,
+		Timestamp:  m.Timestamp,
+		Sequence:   m.Sequence,
+		ServerID:   m.ServerID,
+		Historical: m.Historical,
+		Op:         m.Op,
+		Conn:       m.Conn,
+	}
+	if !utf8.Valid(m.Data) {
+		e.Payload = base64.StdEncoding.EncodeToString(m.Data)
+		e.Encoding = Base64Encoding
+	}
+	return e
+}
+
+// MarshalJSON renders the message as a JSON event, with the payload as text
+// unless it's binary.
+func (m *SniffedMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Envelope())
+}
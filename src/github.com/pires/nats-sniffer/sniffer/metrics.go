@@ -0,0 +1,49 @@
+package sniffer
+
+import (
+	"sync/atomic"
+)
+
+// Metrics describes what the sniffer has been up to, e.g. to be exported
+// to a monitoring system. Counters only ever go up.
+type Metrics struct {
+	// Received counts the messages received from NATS or injected.
+	Received uint64
+	// Delivered and Dropped count the messages handed to handlers, and
+	// the ones dropped for handlers being too slow.
+	Delivered uint64
+	Dropped   uint64
+	// Reconnects counts the NATS connections got back after losing them.
+	Reconnects uint64
+	State      ConnectionState
+	// Subscriptions are the NATS subscriptions held.
+	Subscriptions []SubscriptionMetrics
+	// Handlers maps sniffed subjects to their number of handlers.
+	Handlers map[string]int
+}
+
+// SubscriptionMetrics describes a NATS subscription, along with the
+// messages received but not handed to the sniffer yet.
+type SubscriptionMetrics struct {
+	Subject         string
+	PendingMessages int
+	PendingBytes    int
+}
+
+// Metrics returns what the sniffer has been up to so far.
+func (s *Sniffer) Metrics() Metrics {
+	m := Metrics{
+		Received:  atomic.LoadUint64(&s.registry.received),
+		Delivered: atomic.LoadUint64(&s.totals.delivered),
+		Dropped:   atomic.LoadUint64(&s.totals.dropped),
+		Handlers:  make(map[string]int),
+	}
+	s.registry.metrics(&m)
+
+	s.statuses.mutex.RLock()
+	m.Reconnects = s.statuses.reconnects
+	m.State = s.statuses.status.State
+	s.statuses.mutex.RUnlock()
+
+	return m
+}
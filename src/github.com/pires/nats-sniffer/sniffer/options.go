@@ -0,0 +1,141 @@
+package sniffer
+
+import (
+	"time"
+
+	"github.com/nats-io/nats"
+)
+
+// Option configures a sniffer when it's created.
+type Option func(*Sniffer)
+
+// WithConn makes the sniffer use an existing NATS connection instead of
+// creating its own. The connection is left open when the sniffer stops,
+// and recovering it is up to its owner.
+func WithConn(nc *nats.Conn) Option {
+	return func(s *Sniffer) {
+		s.natsConn = nc
+		s.ownsConn = false
+	}
+}
+
+// WithoutConn makes the sniffer work without any NATS connection, e.g.
+// to analyze recorded traffic. Only messages given to Inject are sniffed.
+func WithoutConn() Option {
+	return func(s *Sniffer) {
+		s.natsConn = nil
+		s.ownsConn = false
+		s.offline = true
+	}
+}
+
+// WithQueueSize sets the number of messages buffered for each handler.
+func WithQueueSize(size int) Option {
+	return func(s *Sniffer) {
+		s.QueueSize = size
+	}
+}
+
+// WithSlowConsumerPolicy sets what to do when a handler queue is full.
+func WithSlowConsumerPolicy(policy SlowConsumerPolicy) Option {
+	return func(s *Sniffer) {
+		s.SlowConsumerPolicy = policy
+	}
+}
+
+// WithHistory bounds the number of messages and payload bytes kept per
+// sniffed subject for late-joining clients. Zero disables history.
+func WithHistory(size int, bytes int) Option {
+	return func(s *Sniffer) {
+		s.HistorySize = size
+		s.HistoryBytes = bytes
+	}
+}
+
+// WithCorrelation pairs every sniffed request with its response, waiting
+// for it as long as timeout, or DefaultRequestTimeout if not positive.
+// See WatchExchanges and LatencyStats.
+func WithCorrelation(timeout time.Duration) Option {
+	return func(s *Sniffer) {
+		if timeout <= 0 {
+			timeout = DefaultRequestTimeout
+		}
+		s.correlator = newCorrelator(timeout)
+	}
+}
+
+// WithUserInfo authenticates with a user and password against NATS
+// servers whose URL doesn't carry credentials.
+func WithUserInfo(user string, password string) Option {
+	return func(s *Sniffer) {
+		s.User = user
+		s.Password = password
+	}
+}
+
+// WithToken authenticates with a token against NATS servers whose URL
+// doesn't carry credentials.
+func WithToken(token string) Option {
+	return func(s *Sniffer) {
+		s.Token = token
+	}
+}
+
+// WithTLS sets the CA certificate used to verify NATS servers and,
+// optionally, the client certificate and key for mutual TLS.
+func WithTLS(caFile string, certFile string, keyFile string) Option {
+	return func(s *Sniffer) {
+		s.CAFile = caFile
+		s.CertFile = certFile
+		s.KeyFile = keyFile
+	}
+}
+
+// SniffOption configures a client registered with Sniff or Subscribe.
+type SniffOption func(*sniffOptions)
+
+type sniffOptions struct {
+	queueSize int
+	policy    SlowConsumerPolicy
+	filter    Filter
+	replay    Replay
+}
+
+// sniffOptions returns the sniffer defaults for new clients.
+func (s *Sniffer) sniffOptions() sniffOptions {
+	return sniffOptions{
+		queueSize: s.QueueSize,
+		policy:    s.SlowConsumerPolicy,
+	}
+}
+
+// WithBuffer sets the number of messages buffered for the client,
+// overriding the sniffer queue size.
+func WithBuffer(size int) SniffOption {
+	return func(o *sniffOptions) {
+		o.queueSize = size
+	}
+}
+
+// WithPolicy sets what to do when the client buffer is full, overriding
+// the sniffer slow consumer policy.
+func WithPolicy(policy SlowConsumerPolicy) SniffOption {
+	return func(o *sniffOptions) {
+		o.policy = policy
+	}
+}
+
+// WithFilter only delivers messages matching filter.
+func WithFilter(filter Filter) SniffOption {
+	return func(o *sniffOptions) {
+		o.filter = filter
+	}
+}
+
+// WithReplay delivers the messages of the subject history selected by
+// replay before live ones.
+func WithReplay(replay Replay) SniffOption {
+	return func(o *sniffOptions) {
+		o.replay = replay
+	}
+}
@@ -0,0 +1,363 @@
+package sniffer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+var (
+	ERR_INVALID_PCAP = errors.New("Not a pcap or pcapng file.")
+	ERR_CORRUPT_PCAP = errors.New("Corrupt pcap file.")
+)
+
+// maxPacketSize bounds packets read from pcap files, to protect against
+// corrupt lengths.
+const maxPacketSize = 1 << 20
+
+// pcap link types, which tell how packets are framed.
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLoop     = 108
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+)
+
+// DefaultNATSPort is the port NATS servers listen to for clients, unless
+// told otherwise.
+const DefaultNATSPort = 4222
+
+// PcapReader decodes the NATS protocol out of packets captured to a pcap
+// or pcapng file, e.g. by tcpdump. TCP streams to and from the NATS port
+// are put back in order and decoded like a Proxy does, every operation
+// being timestamped with the packet that completed it.
+type PcapReader struct {
+	packets packetReader
+	port    int
+	streams map[tcpFlow]*tcpStream
+	decoded []*SniffedMessage
+}
+
+// NewPcapReader returns a reader for the NATS traffic to and from port
+// captured to r, which may be gzip compressed.
+func NewPcapReader(r io.Reader, port int) (*PcapReader, error) {
+	br, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	packets, err := newPacketReader(br)
+	if err != nil {
+		return nil, err
+	}
+	return &PcapReader{
+		packets: packets,
+		port:    port,
+		streams: make(map[tcpFlow]*tcpStream),
+	}, nil
+}
+
+// Read returns the next operation decoded, or io.EOF once there are no
+// more. Operations of a connection the capture joined midway are decoded
+// from the first one starting a packet.
+func (pr *PcapReader) Read() (*SniffedMessage, error) {
+	for len(pr.decoded) == 0 {
+		p, err := pr.packets.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		pr.add(p)
+	}
+	msg := pr.decoded[0]
+	pr.decoded[0] = nil
+	pr.decoded = pr.decoded[1:]
+	return msg, nil
+}
+
+// add decodes the NATS traffic carried by a packet, if any.
+func (pr *PcapReader) add(p *packet) {
+	s, ok := decodeSegment(p)
+	if !ok {
+		return
+	}
+	var client string
+	switch {
+	case s.dstPort == pr.port:
+		client = s.src
+	case s.srcPort == pr.port:
+		client = s.dst
+	default:
+		return
+	}
+
+	flow := tcpFlow{src: s.src, dst: s.dst}
+	stream, ok := pr.streams[flow]
+	if !ok || s.flags&tcpSyn != 0 {
+		stream = newTCPStream(NewProtocolParser(client, func(msg *SniffedMessage) {
+			pr.decoded = append(pr.decoded, msg)
+		}))
+		pr.streams[flow] = stream
+	}
+	stream.add(s, p.timestamp)
+	if s.flags&(tcpFin|tcpRst) != 0 {
+		delete(pr.streams, flow)
+	}
+}
+
+// packet is a packet read from a pcap file, as captured on the wire.
+type packet struct {
+	timestamp time.Time
+	linkType  int
+	data      []byte
+}
+
+// packetReader reads the packets of a pcap or pcapng file, returning
+// io.EOF once there are no more.
+type packetReader interface {
+	readPacket() (*packet, error)
+}
+
+// newPacketReader returns a reader for a pcap or pcapng file, telling
+// them apart by their contents.
+func newPacketReader(br *bufio.Reader) (packetReader, error) {
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, ERR_INVALID_PCAP
+	}
+	switch {
+	case binary.BigEndian.Uint32(magic) == pcapngSectionHeader:
+		return &pcapngReader{r: br}, nil
+	default:
+		return newPcapFileReader(br)
+	}
+}
+
+// A pcap file is a header followed by a record per packet:
+//
+//	header:  magic (uint32) | version (2 x uint16) | time zone (int32)
+//	         accuracy (uint32) | snapshot length (uint32) | link type (uint32)
+//	record:  seconds (uint32) | microseconds or nanoseconds (uint32)
+//	         captured length (uint32) | original length (uint32) | data
+//
+// The magic tells both the byte order and the timestamp resolution.
+const (
+	pcapMagicMicroseconds = 0xa1b2c3d4
+	pcapMagicNanoseconds  = 0xa1b23c4d
+)
+
+type pcapFileReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	linkType int
+}
+
+func newPcapFileReader(r io.Reader) (*pcapFileReader, error) {
+	var header [24]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, ERR_INVALID_PCAP
+	}
+
+	pr := &pcapFileReader{r: r}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(header[:4]) {
+		case pcapMagicMicroseconds:
+			pr.order = order
+		case pcapMagicNanoseconds:
+			pr.order, pr.nanos = order, true
+		}
+	}
+	if pr.order == nil {
+		return nil, ERR_INVALID_PCAP
+	}
+	pr.linkType = int(pr.order.Uint32(header[20:]) & 0xffff)
+
+	return pr, nil
+}
+
+func (pr *pcapFileReader) readPacket() (*packet, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(pr.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ERR_CORRUPT_PCAP
+		}
+		return nil, err
+	}
+	length := pr.order.Uint32(header[8:])
+	if length > maxPacketSize {
+		return nil, ERR_CORRUPT_PCAP
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(pr.r, data); err != nil {
+		return nil, ERR_CORRUPT_PCAP
+	}
+
+	fraction := time.Duration(pr.order.Uint32(header[4:]))
+	if !pr.nanos {
+		fraction *= time.Microsecond
+	}
+	return &packet{
+		timestamp: time.Unix(int64(pr.order.Uint32(header[:4])), int64(fraction)),
+		linkType:  pr.linkType,
+		data:      data,
+	}, nil
+}
+
+// A pcapng file is a sequence of blocks, each made of a type (uint32), a
+// total length (uint32), a body and the total length again. Sections
+// start with a section header block, which tells the byte order of the
+// blocks that follow, and declare interfaces, each with its link type and
+// timestamp resolution, before the packets captured on them.
+const (
+	pcapngSectionHeader      = 0x0a0d0d0a
+	pcapngInterface          = 0x00000001
+	pcapngEnhancedPacket     = 0x00000006
+	pcapngByteOrderMagic     = 0x1a2b3c4d
+	pcapngOptionEnd          = 0
+	pcapngOptionTsResolution = 9
+)
+
+type pcapngReader struct {
+	r          io.Reader
+	order      binary.ByteOrder
+	interfaces []pcapngInterfaceInfo
+}
+
+type pcapngInterfaceInfo struct {
+	linkType int
+	// unit is the duration of a timestamp tick
+	unit time.Duration
+}
+
+func (pr *pcapngReader) readPacket() (*packet, error) {
+	for {
+		blockType, body, err := pr.readBlock()
+		if err != nil {
+			return nil, err
+		}
+
+		switch blockType {
+		case pcapngSectionHeader:
+			pr.interfaces = nil
+		case pcapngInterface:
+			if len(body) < 8 {
+				return nil, ERR_CORRUPT_PCAP
+			}
+			info := pcapngInterfaceInfo{
+				linkType: int(pr.order.Uint16(body)),
+				unit:     time.Microsecond,
+			}
+			if unit, ok := pr.tsResolution(body[8:]); ok {
+				info.unit = unit
+			}
+			pr.interfaces = append(pr.interfaces, info)
+		case pcapngEnhancedPacket:
+			if len(body) < 20 {
+				return nil, ERR_CORRUPT_PCAP
+			}
+			id := int(pr.order.Uint32(body))
+			length := int(pr.order.Uint32(body[12:]))
+			if id >= len(pr.interfaces) || length > len(body)-20 {
+				return nil, ERR_CORRUPT_PCAP
+			}
+			info := pr.interfaces[id]
+			ticks := uint64(pr.order.Uint32(body[4:]))<<32 | uint64(pr.order.Uint32(body[8:]))
+			return &packet{
+				timestamp: pcapngTime(ticks, info.unit),
+				linkType:  info.linkType,
+				data:      body[20 : 20+length],
+			}, nil
+		}
+		// other blocks, e.g. statistics, don't matter
+	}
+}
+
+// readBlock reads the next block, returning its type and body. Section
+// header blocks set the byte order of the blocks that follow.
+func (pr *pcapngReader) readBlock() (uint32, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(pr.r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, ERR_CORRUPT_PCAP
+		}
+		return 0, nil, err
+	}
+
+	blockType := binary.BigEndian.Uint32(header[:4])
+	if blockType == pcapngSectionHeader {
+		var magic [4]byte
+		if _, err := io.ReadFull(pr.r, magic[:]); err != nil {
+			return 0, nil, ERR_CORRUPT_PCAP
+		}
+		switch {
+		case binary.BigEndian.Uint32(magic[:]) == pcapngByteOrderMagic:
+			pr.order = binary.BigEndian
+		case binary.LittleEndian.Uint32(magic[:]) == pcapngByteOrderMagic:
+			pr.order = binary.LittleEndian
+		default:
+			return 0, nil, ERR_INVALID_PCAP
+		}
+		// the magic is part of the body
+		body, err := pr.readBody(header[4:], 4)
+		return blockType, body, err
+	}
+	if pr.order == nil {
+		return 0, nil, ERR_INVALID_PCAP
+	}
+
+	body, err := pr.readBody(header[4:], 0)
+	return pr.order.Uint32(header[:4]), body, err
+}
+
+// readBody reads the rest of a block of the given total length, skipping
+// what was read of its body already.
+func (pr *pcapngReader) readBody(length []byte, read int) ([]byte, error) {
+	total := int(pr.order.Uint32(length))
+	if total < 12+read || total > maxPacketSize || total%4 != 0 {
+		return nil, ERR_CORRUPT_PCAP
+	}
+	rest := make([]byte, total-8-read)
+	if _, err := io.ReadFull(pr.r, rest); err != nil {
+		return nil, ERR_CORRUPT_PCAP
+	}
+	// leave out the trailing total length
+	return rest[:len(rest)-4], nil
+}
+
+// tsResolution looks for the timestamp resolution among interface options.
+func (pr *pcapngReader) tsResolution(options []byte) (time.Duration, bool) {
+	for len(options) >= 4 {
+		code := pr.order.Uint16(options)
+		length := int(pr.order.Uint16(options[2:]))
+		if code == pcapngOptionEnd || len(options) < 4+length {
+			break
+		}
+		if code == pcapngOptionTsResolution && length >= 1 {
+			resolution := options[4]
+			unit := time.Second
+			for i := 0; i < int(resolution&0x7f); i++ {
+				if resolution&0x80 != 0 {
+					unit /= 2
+				} else {
+					unit /= 10
+				}
+			}
+			if unit > 0 {
+				return unit, true
+			}
+		}
+		options = options[4+(length+3)/4*4:]
+	}
+	return 0, false
+}
+
+// pcapngTime converts a number of timestamp ticks since the Unix epoch.
+func pcapngTime(ticks uint64, unit time.Duration) time.Time {
+	perSecond := uint64(time.Second / unit)
+	seconds := ticks / perSecond
+	return time.Unix(int64(seconds), int64(ticks%perSecond)*int64(unit))
+}
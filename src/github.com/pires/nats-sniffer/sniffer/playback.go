@@ -0,0 +1,249 @@
+package sniffer
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ERR_INVALID_SPEED = errors.New("Playback speed must be positive.")
+
+// PlaybackState describes where a playback stands.
+type PlaybackState struct {
+	Playing bool    `json:"playing"`
+	Speed   float64 `json:"speed"`
+	// Position is the recording time played up to.
+	Position time.Time `json:"position"`
+	// Played is the number of messages played since the start of the
+	// recording, including those skipped by seeking.
+	Played int       `json:"played"`
+	Total  int       `json:"total"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+}
+
+// Playback plays recorded messages back at their original pace, or a
+// multiple of it, so that they can be sniffed as if they were live. It
+// can be paused, sped up and moved around the recording at any time.
+type Playback struct {
+	messages []*SniffedMessage
+	deliver  func(msg *SniffedMessage)
+	// next is the index of the next message to be played
+	next    int
+	playing bool
+	speed   float64
+	// position is the recording time played up to when wall was the
+	// current time
+	position time.Time
+	wall     time.Time
+	changed  chan struct{}
+	quit     chan struct{}
+	done     chan struct{}
+	mutex    sync.Mutex
+}
+
+// ReadMessages reads every message of several recordings, and returns
+// them in the order they were recorded.
+func ReadMessages(readers ...MessageReader) ([]*SniffedMessage, error) {
+	var messages []*SniffedMessage
+	for _, r := range readers {
+		for {
+			msg, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, msg)
+		}
+	}
+	sort.Stable(byTimestamp(messages))
+	return messages, nil
+}
+
+// byTimestamp sorts messages by the time they were sniffed.
+type byTimestamp []*SniffedMessage
+
+func (b byTimestamp) Len() int           { return len(b) }
+func (b byTimestamp) Less(i, j int) bool { return b[i].Timestamp.Before(b[j].Timestamp) }
+func (b byTimestamp) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// NewPlayback returns a playback of messages, sorted by timestamp, paused
+// at the first one. Played messages are given to deliver, e.g. the Inject
+// method of a sniffer.
+func NewPlayback(messages []*SniffedMessage, deliver func(msg *SniffedMessage)) *Playback {
+	p := &Playback{
+		messages: messages,
+		deliver:  deliver,
+		speed:    1,
+		changed:  make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if len(messages) > 0 {
+		p.position = messages[0].Timestamp
+	}
+	return p
+}
+
+// Start starts delivering messages whenever playing.
+func (p *Playback) Start() {
+	go p.run()
+}
+
+// Stop stops delivering messages, and waits for any delivery in flight.
+func (p *Playback) Stop() {
+	close(p.quit)
+	<-p.done
+}
+
+func (p *Playback) run() {
+	defer close(p.done)
+
+	for {
+		due, wait := p.due()
+		for _, msg := range due {
+			p.deliver(msg)
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-p.quit:
+			return
+		case <-p.changed:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// due returns the messages due to be played, and how long to wait for
+// the next one. A negative wait means there's nothing to wait for until
+// the playback changes. Playback pauses once the recording is over.
+func (p *Playback) due() ([]*SniffedMessage, time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.playing {
+		return nil, -1
+	}
+
+	now := p.now()
+	first := p.next
+	for p.next < len(p.messages) && !p.messages[p.next].Timestamp.After(now) {
+		p.next++
+	}
+	due := p.messages[first:p.next]
+
+	if p.next == len(p.messages) {
+		p.position = now
+		if len(p.messages) > 0 && now.After(p.messages[len(p.messages)-1].Timestamp) {
+			p.position = p.messages[len(p.messages)-1].Timestamp
+		}
+		p.playing = false
+		return due, -1
+	}
+	return due, time.Duration(float64(p.messages[p.next].Timestamp.Sub(now)) / p.speed)
+}
+
+// now returns the recording time currently played. The lock is assumed
+// to be held upon entering.
+func (p *Playback) now() time.Time {
+	if !p.playing {
+		return p.position
+	}
+	return p.position.Add(time.Duration(float64(time.Since(p.wall)) * p.speed))
+}
+
+// change applies a change to the playback, keeping track of the
+// recording time played so far.
+func (p *Playback) change(f func()) {
+	p.mutex.Lock()
+	p.position = p.now()
+	p.wall = time.Now()
+	f()
+	p.mutex.Unlock()
+
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Play resumes playing, from the start if the recording is over.
+func (p *Playback) Play() {
+	p.change(func() {
+		if p.next == len(p.messages) {
+			p.seek(time.Time{})
+		}
+		p.playing = true
+	})
+}
+
+// Pause stops playing until Play is called.
+func (p *Playback) Pause() {
+	p.change(func() {
+		p.playing = false
+	})
+}
+
+// Seek moves the playback to a time of the recording. Messages skipped
+// aren't played, and those before t are played again.
+func (p *Playback) Seek(t time.Time) {
+	p.change(func() {
+		p.seek(t)
+	})
+}
+
+// seek moves the playback to a time of the recording, or to its start if
+// t is zero. The lock is assumed to be held upon entering.
+func (p *Playback) seek(t time.Time) {
+	if t.IsZero() && len(p.messages) > 0 {
+		t = p.messages[0].Timestamp
+	}
+	p.position = t
+	p.next = sort.Search(len(p.messages), func(i int) bool {
+		return !p.messages[i].Timestamp.Before(t)
+	})
+}
+
+// SetSpeed changes the pace messages are played at, e.g. 2 plays them
+// twice as fast as they were recorded.
+func (p *Playback) SetSpeed(speed float64) error {
+	if speed <= 0 {
+		return ERR_INVALID_SPEED
+	}
+	p.change(func() {
+		p.speed = speed
+	})
+	return nil
+}
+
+// State returns where the playback stands.
+func (p *Playback) State() PlaybackState {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	state := PlaybackState{
+		Playing:  p.playing,
+		Speed:    p.speed,
+		Position: p.now(),
+		Played:   p.next,
+		Total:    len(p.messages),
+	}
+	if len(p.messages) > 0 {
+		state.Start = p.messages[0].Timestamp
+		state.End = p.messages[len(p.messages)-1].Timestamp
+	}
+	return state
+}
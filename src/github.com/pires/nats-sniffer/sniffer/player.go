@@ -0,0 +1,146 @@
+package sniffer
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats"
+)
+
+// Player publishes recorded messages again, e.g. to reproduce an incident
+// against a staging cluster.
+type Player struct {
+	// Speed multiplies the original pace of messages, e.g. 2 plays them
+	// twice as fast. Zero plays them as fast as possible.
+	Speed float64
+	// MaxRate bounds the number of messages played per second, if
+	// positive.
+	MaxRate float64
+	// Filter selects the messages played, if set.
+	Filter Filter
+	// From and To select messages recorded within a time range, if set.
+	From time.Time
+	To   time.Time
+	// Rewrite replaces subject prefixes, e.g. prod. with staging.
+	// The longest matching prefix wins.
+	Rewrite map[string]string
+
+	// first and start are when the first message played was recorded and
+	// played, and last when the latest was played.
+	first, start, last time.Time
+}
+
+// NewPlayer returns a player keeping the original pace of messages.
+func NewPlayer() *Player {
+	return &Player{Speed: 1}
+}
+
+// Play reads messages from r and publishes those selected, at the
+// configured pace, until r has no more messages or ctx is done. Filters
+// apply to the original subjects. Out of operations decoded from the NATS
+// protocol, e.g. by a proxy, only PUB ones are published: MSG ones are
+// their deliveries, and the others aren't messages. It returns the number
+// of messages published. The pace carries over consecutive calls, so that
+// files rotated while recording play as one.
+func (p *Player) Play(ctx context.Context, r MessageReader, publish func(msg *SniffedMessage) error) (int, error) {
+	played := 0
+	for {
+		msg, err := r.Read()
+		if err == io.EOF {
+			return played, nil
+		}
+		if err != nil {
+			return played, err
+		}
+		if !p.selects(msg) {
+			continue
+		}
+
+		// the original pace is relative to the first message ever played
+		now := time.Now()
+		due := now
+		if p.Speed > 0 {
+			if p.start.IsZero() {
+				p.first, p.start = msg.Timestamp, now
+			}
+			due = p.start.Add(time.Duration(float64(msg.Timestamp.Sub(p.first)) / p.Speed))
+		}
+		if p.MaxRate > 0 && !p.last.IsZero() {
+			if next := p.last.Add(time.Duration(float64(time.Second) / p.MaxRate)); next.After(due) {
+				due = next
+			}
+		}
+		if wait := due.Sub(now); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return played, ctx.Err()
+			case <-timer.C:
+			}
+		} else if err := ctx.Err(); err != nil {
+			return played, err
+		}
+
+		if err := publish(p.rewrite(msg)); err != nil {
+			return played, err
+		}
+		played++
+		p.last = time.Now()
+	}
+}
+
+// selects tells whether a message is to be played.
+func (p *Player) selects(msg *SniffedMessage) bool {
+	if msg.Op != "" && msg.Op != OpPub {
+		return false
+	}
+	if !p.From.IsZero() && msg.Timestamp.Before(p.From) {
+		return false
+	}
+	if !p.To.IsZero() && msg.Timestamp.After(p.To) {
+		return false
+	}
+	return p.Filter == nil || p.Filter.Match(msg)
+}
+
+// rewrite returns a copy of a message with its subject prefix replaced,
+// if any matches.
+func (p *Player) rewrite(msg *SniffedMessage) *SniffedMessage {
+	longest := ""
+	for prefix := range p.Rewrite {
+		if len(prefix) > len(longest) && strings.HasPrefix(msg.Subject, prefix) {
+			longest = prefix
+		}
+	}
+	if longest == "" {
+		return msg
+	}
+	m := *msg
+	m.Subject = p.Rewrite[longest] + strings.TrimPrefix(msg.Subject, longest)
+	return &m
+}
+
+// Publisher returns a function publishing messages to nc, along with their
+// reply inbox if any, for a player to play them to. Every now and then,
+// the connection is flushed so that errors surface.
+func Publisher(nc *nats.Conn) func(msg *SniffedMessage) error {
+	published := 0
+	return func(msg *SniffedMessage) error {
+		var err error
+		if msg.Reply != "" {
+			err = nc.PublishRequest(msg.Subject, msg.Reply, msg.Data)
+		} else {
+			err = nc.Publish(msg.Subject, msg.Data)
+		}
+		if err != nil {
+			return err
+		}
+		if published++; published%1000 == 0 {
+			return nc.Flush()
+		}
+		return nil
+	}
+}
@@ -0,0 +1,217 @@
+package sniffer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ERR_INVALID_PROTOCOL = errors.New("Invalid NATS protocol.")
+
+// NATS protocol operations.
+const (
+	OpConnect = "CONNECT"
+	OpInfo    = "INFO"
+	OpPub     = "PUB"
+	OpSub     = "SUB"
+	OpUnsub   = "UNSUB"
+	OpMsg     = "MSG"
+	OpPing    = "PING"
+	OpPong    = "PONG"
+	OpOK      = "+OK"
+	OpErr     = "-ERR"
+)
+
+// ProtocolSubjectPrefix starts the subjects of operations unrelated to any
+// subject, e.g. _NATS.connect or _NATS.ping, so that they can be sniffed
+// like messages.
+const ProtocolSubjectPrefix = "_NATS."
+
+const (
+	// maxControlLine bounds operation lines, CONNECT and INFO included.
+	maxControlLine = 64 << 10
+	// maxProtocolPayload bounds message payloads, as NATS servers do.
+	maxProtocolPayload = 64 << 20
+)
+
+// ProtocolParser decodes one direction of a NATS connection, from client to
+// server or the other way around, into operations. PUB and MSG operations
+// become messages of their subject, SUB and UNSUB ones messages of the
+// subject subscribed, and the others messages of ProtocolSubjectPrefix
+// followed by the operation.
+type ProtocolParser struct {
+	conn    string
+	handler SniffedMessageHandler
+	buf     []byte
+	// subjects maps subscription ids to subjects, for UNSUB
+	subjects map[string]string
+	err      error
+}
+
+// NewProtocolParser returns a parser calling handler for every operation
+// of connection conn.
+func NewProtocolParser(conn string, handler SniffedMessageHandler) *ProtocolParser {
+	return &ProtocolParser{
+		conn:     conn,
+		handler:  handler,
+		subjects: make(map[string]string),
+	}
+}
+
+// Parse decodes the operations completed by data, received at ts. Once
+// the protocol can't be decoded, e.g. because the connection switched to
+// TLS, Parse keeps returning the same error.
+func (p *ProtocolParser) Parse(data []byte, ts time.Time) error {
+	if p.err != nil {
+		return p.err
+	}
+
+	p.buf = append(p.buf, data...)
+	for len(p.buf) > 0 {
+		n, err := p.parse(ts)
+		if err != nil {
+			p.err = err
+			p.buf = nil
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		p.buf = p.buf[n:]
+	}
+	if len(p.buf) == 0 {
+		p.buf = nil
+	}
+	return nil
+}
+
+// parse decodes the operation at the start of the buffer and returns its
+// length, or zero if it's incomplete.
+func (p *ProtocolParser) parse(ts time.Time) (int, error) {
+	end := bytes.IndexByte(p.buf, '\n')
+	if end < 0 {
+		if len(p.buf) > maxControlLine {
+			return 0, ERR_INVALID_PROTOCOL
+		}
+		return 0, nil
+	}
+	line := strings.TrimSuffix(string(p.buf[:end]), "\r")
+	n := end + 1
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return n, nil
+	}
+	msg := &SniffedMessage{
+		Op:        strings.ToUpper(fields[0]),
+		Conn:      p.conn,
+		Timestamp: ts,
+	}
+	args := fields[1:]
+	rest := strings.TrimSpace(line[len(fields[0]):])
+
+	switch msg.Op {
+	case OpPub, OpMsg:
+		// PUB <subject> [reply] <size> and MSG <subject> <sid> [reply] <size>
+		min := 2
+		if msg.Op == OpMsg {
+			min = 3
+		}
+		if len(args) < min || len(args) > min+1 {
+			return 0, ERR_INVALID_PROTOCOL
+		}
+		size, err := strconv.Atoi(args[len(args)-1])
+		if err != nil || size < 0 || size > maxProtocolPayload {
+			return 0, ERR_INVALID_PROTOCOL
+		}
+		if len(args) > min {
+			msg.Reply = args[len(args)-2]
+		}
+		msg.Subject = args[0]
+
+		if len(p.buf) < n+size+2 {
+			return 0, nil
+		}
+		if p.buf[n+size] != '\r' || p.buf[n+size+1] != '\n' {
+			return 0, ERR_INVALID_PROTOCOL
+		}
+		msg.Data = append([]byte(nil), p.buf[n:n+size]...)
+		n += size + 2
+	case OpSub:
+		// SUB <subject> [queue] <sid>
+		if len(args) < 2 || len(args) > 3 {
+			return 0, ERR_INVALID_PROTOCOL
+		}
+		sub := struct {
+			Sid   string `json:"sid"`
+			Queue string `json:"queue,omitempty"`
+		}{Sid: args[len(args)-1]}
+		if len(args) == 3 {
+			sub.Queue = args[1]
+		}
+		msg.Subject = args[0]
+		msg.Data, _ = json.Marshal(&sub)
+		p.subjects[sub.Sid] = msg.Subject
+	case OpUnsub:
+		// UNSUB <sid> [max]
+		if len(args) < 1 || len(args) > 2 {
+			return 0, ERR_INVALID_PROTOCOL
+		}
+		unsub := struct {
+			Sid string `json:"sid"`
+			Max int    `json:"max,omitempty"`
+		}{Sid: args[0]}
+		if len(args) == 2 {
+			max, err := strconv.Atoi(args[1])
+			if err != nil {
+				return 0, ERR_INVALID_PROTOCOL
+			}
+			unsub.Max = max
+		}
+		subject, ok := p.subjects[unsub.Sid]
+		if !ok {
+			subject = protocolSubject(msg.Op)
+		} else if unsub.Max == 0 {
+			delete(p.subjects, unsub.Sid)
+		}
+		msg.Subject = subject
+		msg.Data, _ = json.Marshal(&unsub)
+	case OpConnect, OpInfo:
+		msg.Subject = protocolSubject(msg.Op)
+		msg.Data = []byte(rest)
+	case OpErr:
+		msg.Subject = protocolSubject(msg.Op)
+		msg.Data = []byte(strings.Trim(rest, "'"))
+	case OpPing, OpPong, OpOK:
+		msg.Subject = protocolSubject(msg.Op)
+	default:
+		return 0, ERR_INVALID_PROTOCOL
+	}
+
+	msg.Size = len(msg.Data)
+	p.handler(msg)
+	return n, nil
+}
+
+// startsOperation tells whether data starts with a known operation, e.g.
+// to find where to begin decoding a connection joined midway.
+func startsOperation(data []byte) bool {
+	end := bytes.IndexAny(data, " \t\r\n")
+	if end < 0 {
+		return false
+	}
+	switch strings.ToUpper(string(data[:end])) {
+	case OpConnect, OpInfo, OpPub, OpSub, OpUnsub, OpMsg, OpPing, OpPong, OpOK, OpErr:
+		return true
+	}
+	return false
+}
+
+// protocolSubject returns the subject of an operation unrelated to any
+// subject, e.g. _NATS.ok for +OK.
+func protocolSubject(op string) string {
+	return ProtocolSubjectPrefix + strings.ToLower(strings.Trim(op, "+-"))
+}
@@ -0,0 +1,172 @@
+package sniffer
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// proxyDialTimeout bounds connecting to the upstream NATS server.
+const proxyDialTimeout = 5 * time.Second
+
+// Proxy sits between NATS clients and a NATS server, decoding every
+// operation going through, so that connections, subscriptions and
+// CONNECT options can be sniffed along with messages. Traffic is
+// forwarded as is, even when it can't be decoded, e.g. over TLS.
+type Proxy struct {
+	upstream string
+	handler  SniffedMessageHandler
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+	mutex    sync.Mutex
+}
+
+// NewProxy returns a proxy forwarding clients to the NATS server at
+// upstream, e.g. localhost:4222, and calling handler for every operation
+// decoded, e.g. the Inject method of a sniffer.
+func NewProxy(upstream string, handler SniffedMessageHandler) *Proxy {
+	return &Proxy{
+		upstream: upstream,
+		handler:  handler,
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts clients on l until the proxy is closed.
+func (p *Proxy) Serve(l net.Listener) error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		l.Close()
+		return ERR_SNIFFER_STOPPED
+	}
+	p.listener = l
+	p.mutex.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			p.mutex.Lock()
+			closed := p.closed
+			p.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		if !p.track(conn) {
+			conn.Close()
+			return nil
+		}
+		p.wg.Add(1)
+		go p.proxy(conn)
+	}
+}
+
+// Close stops accepting clients, disconnects the current ones and waits
+// for their operations to be handled.
+func (p *Proxy) Close() error {
+	p.mutex.Lock()
+	p.closed = true
+	var err error
+	if p.listener != nil {
+		err = p.listener.Close()
+	}
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.mutex.Unlock()
+
+	p.wg.Wait()
+	return err
+}
+
+// track registers a connection to be closed along with the proxy, unless
+// it's closed already.
+func (p *Proxy) track(conn net.Conn) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrack(conn net.Conn) {
+	p.mutex.Lock()
+	delete(p.conns, conn)
+	p.mutex.Unlock()
+	conn.Close()
+}
+
+// proxy forwards a client to the upstream server, in both directions,
+// until either side goes away.
+func (p *Proxy) proxy(client net.Conn) {
+	defer p.wg.Done()
+	defer p.untrack(client)
+
+	id := client.RemoteAddr().String()
+	server, err := net.DialTimeout("tcp", p.upstream, proxyDialTimeout)
+	if err != nil {
+		fmt.Printf("Error proxying [%s] to [%s]: %s\n", id, p.upstream, err.Error())
+		return
+	}
+	if !p.track(server) {
+		server.Close()
+		return
+	}
+	defer p.untrack(server)
+
+	fmt.Printf("Proxying [%s] to [%s].\n", id, p.upstream)
+
+	// operations of a connection are handled in the order they're decoded
+	var mutex sync.Mutex
+	handler := func(msg *SniffedMessage) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		p.handler(msg)
+	}
+
+	// once either side goes away, so does the other
+	done := make(chan struct{})
+	go func() {
+		p.forward(server, client, NewProtocolParser(id, handler))
+		client.Close()
+		server.Close()
+		close(done)
+	}()
+	p.forward(client, server, NewProtocolParser(id, handler))
+	client.Close()
+	server.Close()
+	<-done
+
+	fmt.Printf("Stopped proxying [%s].\n", id)
+}
+
+// forward copies whatever src sends to dst, decoding it on the way.
+func (p *Proxy) forward(dst net.Conn, src net.Conn, parser *ProtocolParser) {
+	buf := make([]byte, 32<<10)
+	decoding := true
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+			if decoding {
+				if err := parser.Parse(buf[:n], time.Now()); err != nil {
+					fmt.Printf("Can't decode traffic of [%s] anymore: %s\n", parser.conn, err.Error())
+					decoding = false
+				}
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
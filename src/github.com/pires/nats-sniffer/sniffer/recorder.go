@@ -0,0 +1,180 @@
+package sniffer
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ERR_RECORDER_CLOSED = errors.New("Recorder is closed.")
+
+const (
+	// CaptureExtension is the extension of capture files.
+	CaptureExtension = ".ncap"
+	// captureTimeFormat names capture files after the moment they were
+	// created, so that they sort chronologically.
+	captureTimeFormat = "20060102T150405.000000000Z"
+)
+
+// RecorderStats holds the counters of a recorder.
+type RecorderStats struct {
+	Records uint64 `json:"records"`
+	// Bytes counts capture bytes written, before compression.
+	Bytes int64    `json:"bytes"`
+	Files []string `json:"files"`
+}
+
+// Recorder writes sniffed messages to capture files, starting a new file
+// once the current one is too big or too old.
+type Recorder struct {
+	// Prefix is the path capture files are named after, e.g. captures/db
+	// for captures/db-20160301T100000.000000000Z.ncap.
+	Prefix string
+	// MaxBytes bounds the size of a capture file before compression, if
+	// positive.
+	MaxBytes int64
+	// MaxAge bounds how long messages are written to a capture file, if
+	// positive. Files are only rotated when a message arrives.
+	MaxAge time.Duration
+	// Compress gzips capture files, which are then named .ncap.gz.
+	Compress bool
+
+	file    *os.File
+	zw      *gzip.Writer
+	cw      *CaptureWriter
+	size    int64
+	created time.Time
+	stats   RecorderStats
+	closed  bool
+	mutex   sync.Mutex
+}
+
+// NewRecorder returns a recorder writing capture files named after prefix.
+// Files are created as messages arrive.
+func NewRecorder(prefix string) *Recorder {
+	return &Recorder{Prefix: prefix}
+}
+
+// Record appends a message to the current capture file, rotating it first
+// if needed.
+func (r *Recorder) Record(msg *SniffedMessage) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return ERR_RECORDER_CLOSED
+	}
+	if r.file != nil && ((r.MaxBytes > 0 && r.size >= r.MaxBytes) ||
+		(r.MaxAge > 0 && time.Since(r.created) >= r.MaxAge)) {
+		if err := r.closeFile(); err != nil {
+			return err
+		}
+	}
+	if r.file == nil {
+		if err := r.openFile(); err != nil {
+			return err
+		}
+	}
+
+	if err := r.cw.Write(msg); err != nil {
+		return err
+	}
+	r.stats.Records++
+	return nil
+}
+
+// Close closes the current capture file. Nothing is recorded afterwards.
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if r.file == nil {
+		return nil
+	}
+	return r.closeFile()
+}
+
+// Stats returns a snapshot of the recorder counters.
+func (r *Recorder) Stats() RecorderStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stats := r.stats
+	stats.Files = append([]string{}, r.stats.Files...)
+	return stats
+}
+
+// openFile creates a new capture file. The lock is assumed to be held upon
+// entering.
+func (r *Recorder) openFile() error {
+	now := time.Now().UTC()
+	name := fmt.Sprintf("%s-%s%s", r.Prefix, now.Format(captureTimeFormat), CaptureExtension)
+	if r.Compress {
+		name += ".gz"
+	}
+	if dir := filepath.Dir(name); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	r.file = file
+	r.size = 0
+	r.created = now
+	// count bytes before compression, which buffers data
+	var w io.Writer = file
+	if r.Compress {
+		r.zw = gzip.NewWriter(file)
+		w = r.zw
+	}
+	r.cw, err = NewCaptureWriter(&countingWriter{w: w, n: &r.size, total: &r.stats.Bytes})
+	if err != nil {
+		file.Close()
+		r.file, r.zw, r.cw = nil, nil, nil
+		return err
+	}
+	r.stats.Files = append(r.stats.Files, name)
+
+	return nil
+}
+
+// closeFile flushes and closes the current capture file. The lock is
+// assumed to be held upon entering.
+func (r *Recorder) closeFile() error {
+	var err error
+	if r.zw != nil {
+		err = r.zw.Close()
+	}
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file, r.zw, r.cw = nil, nil, nil
+	return err
+}
+
+// countingWriter counts the bytes written to a capture file.
+type countingWriter struct {
+	w     io.Writer
+	n     *int64
+	total *int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	*cw.n += int64(n)
+	*cw.total += int64(n)
+	return n, err
+}
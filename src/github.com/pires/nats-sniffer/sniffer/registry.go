@@ -0,0 +1,312 @@
+package sniffer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/gnatsd/sublist"
+	"github.com/nats-io/nats"
+)
+
+// subjectRegistry keeps track of the sniffed subjects, the clients
+// interested in each of them and the NATS subscriptions serving them.
+//
+// Overlapping subjects share subscriptions: only subjects not covered by
+// another sniffed subject are subscribed, e.g. sniffing device.> and
+// device.*.connection results in a single subscription to device.>.
+// When a broad subject goes away, the narrower ones it was serving are
+// subscribed again. While subscriptions are re-split, messages already
+// in flight for the removed subscription may be lost.
+//
+// All changes happen under a single lock, so a subject is subscribed when
+// its first client arrives and unsubscribed as soon as its last client
+// goes away.
+type subjectRegistry struct {
+	// accessed atomically
+	received uint64
+
+	interests     map[string]*interest
+	index         *sublist.Sublist
+	subscriptions map[string]*nats.Subscription
+	subscribe     func(subject string) (*nats.Subscription, error)
+	newHistory    func() *history
+	stopped       bool
+	mutex         sync.RWMutex
+}
+
+// interest is a sniffed subject along with its clients.
+type interest struct {
+	// accessed atomically
+	sequence uint64
+
+	subject string
+	clients map[string]*client
+	history *history
+	traffic *traffic
+	// owner is the subject of the subscription serving this interest
+	owner string
+}
+
+// newSubjectRegistry creates an empty registry that uses subscribe to
+// create NATS subscriptions and newHistory to keep the history of every
+// sniffed subject.
+func newSubjectRegistry(subscribe func(subject string) (*nats.Subscription, error), newHistory func() *history) *subjectRegistry {
+	return &subjectRegistry{
+		interests:     make(map[string]*interest),
+		index:         sublist.New(),
+		subscriptions: make(map[string]*nats.Subscription),
+		subscribe:     subscribe,
+		newHistory:    newHistory,
+	}
+}
+
+// add registers a client for a subject, subscribing it if no other
+// subscription covers it yet. The client begins with the messages from
+// the subject history selected by replay, followed by live ones.
+func (r *subjectRegistry) add(subject string, id string, c *client, replay Replay) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.stopped {
+		return ERR_SNIFFER_STOPPED
+	}
+
+	// holding the lock, no live message can sneak in before history
+	if in, ok := r.interests[subject]; ok {
+		c.begin(in.history.replay(replay))
+		in.clients[id] = c
+		return nil
+	}
+
+	in := &interest{
+		subject: subject,
+		clients: map[string]*client{id: c},
+		history: r.newHistory(),
+		traffic: newTraffic(time.Now()),
+	}
+	if err := r.index.Insert([]byte(subject), in); err != nil {
+		return ERR_INVALID_SUBJECT
+	}
+	r.interests[subject] = in
+
+	if err := r.sync(); err != nil {
+		delete(r.interests, subject)
+		r.index.Remove([]byte(subject), in)
+		r.sync()
+		return err
+	}
+	c.begin(nil)
+
+	return nil
+}
+
+// remove unregisters a client. When it's the last client of its subject,
+// subscriptions are re-split as needed. The removed client is returned
+// so it can be stopped.
+func (r *subjectRegistry) remove(subject string, id string) (*client, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	in, ok := r.interests[subject]
+	if !ok {
+		return nil, false
+	}
+	c, ok := in.clients[id]
+	if !ok {
+		return nil, false
+	}
+	delete(in.clients, id)
+	if len(in.clients) == 0 {
+		delete(r.interests, subject)
+		r.index.Remove([]byte(subject), in)
+		r.sync()
+	}
+
+	return c, true
+}
+
+// sync makes subscriptions match the sniffed subjects not covered by any
+// other, and assigns every sniffed subject to a subscription covering it.
+// New subscriptions are created before old ones are removed, so NATS
+// never stops sending us messages someone is interested in.
+// The lock is assumed to be held upon entering.
+func (r *subjectRegistry) sync() error {
+	wanted := make(map[string]bool)
+	for subject := range r.interests {
+		if !r.covered(subject) {
+			wanted[subject] = true
+		}
+	}
+
+	for subject := range wanted {
+		if _, ok := r.subscriptions[subject]; ok {
+			continue
+		}
+		subscription, err := r.subscribe(subject)
+		if err != nil {
+			return err
+		}
+		r.subscriptions[subject] = subscription
+	}
+
+	for _, in := range r.interests {
+		if wanted[in.owner] {
+			continue
+		}
+		if wanted[in.subject] {
+			in.owner = in.subject
+			continue
+		}
+		for subject := range wanted {
+			if SubjectCovers(subject, in.subject) {
+				in.owner = subject
+				break
+			}
+		}
+	}
+
+	for subject, subscription := range r.subscriptions {
+		if !wanted[subject] {
+			if subscription != nil {
+				subscription.Unsubscribe()
+			}
+			delete(r.subscriptions, subject)
+		}
+	}
+
+	return nil
+}
+
+// resubscribe subscribes again every subject that needs to be, after the
+// connection they were subscribed on was replaced.
+func (r *subjectRegistry) resubscribe() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.subscriptions = make(map[string]*nats.Subscription)
+	return r.sync()
+}
+
+// clear unsubscribes everything and unregisters every client, refusing
+// new ones from then on. The removed clients are returned so they can be
+// stopped.
+func (r *subjectRegistry) clear() []*client {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, subscription := range r.subscriptions {
+		if subscription != nil {
+			subscription.Unsubscribe()
+		}
+	}
+
+	var clients []*client
+	for _, in := range r.interests {
+		for _, c := range in.clients {
+			clients = append(clients, c)
+		}
+	}
+
+	r.interests = make(map[string]*interest)
+	r.index = sublist.New()
+	r.subscriptions = make(map[string]*nats.Subscription)
+	r.stopped = true
+
+	return clients
+}
+
+// covered tells whether a sniffed subject is covered by another one.
+// The lock is assumed to be held upon entering.
+func (r *subjectRegistry) covered(subject string) bool {
+	for other := range r.interests {
+		if other != subject && SubjectCovers(other, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// get retrieves a client of a subject.
+func (r *subjectRegistry) get(subject string, id string) (*client, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	in, ok := r.interests[subject]
+	if !ok {
+		return nil, false
+	}
+	c, ok := in.clients[id]
+	return c, ok
+}
+
+// deliver queues a message received through the subscription to via for
+// every client of the sniffed subjects that match it and are served by
+// that subscription. An empty via stands for no subscription at all, and
+// reaches every client of the matching subjects.
+func (r *subjectRegistry) deliver(via string, msg *SniffedMessage) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	atomic.AddUint64(&r.received, 1)
+	now := time.Now()
+	for _, match := range r.index.Match([]byte(msg.Subject)) {
+		in := match.(*interest)
+		if via != "" && in.owner != via {
+			continue
+		}
+		m := *msg
+		m.Sequence = atomic.AddUint64(&in.sequence, 1)
+		in.history.add(&m)
+		in.traffic.add(&m, now)
+		for _, c := range in.clients {
+			c.enqueue(&m)
+		}
+	}
+}
+
+// trafficStats describes the traffic of every sniffed subject.
+func (r *subjectRegistry) trafficStats() []TrafficStats {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	now := time.Now()
+	stats := make([]TrafficStats, 0, len(r.interests))
+	for _, in := range r.interests {
+		stats = append(stats, in.traffic.snapshot(in.subject, now))
+	}
+	return stats
+}
+
+// subjectTrafficStats describes the traffic of a sniffed subject.
+func (r *subjectRegistry) subjectTrafficStats(subject string) (TrafficStats, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	in, ok := r.interests[subject]
+	if !ok {
+		return TrafficStats{}, false
+	}
+	return in.traffic.snapshot(in.subject, time.Now()), true
+}
+
+// metrics describes the NATS subscriptions and the clients of every
+// sniffed subject.
+func (r *subjectRegistry) metrics(m *Metrics) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for subject, subscription := range r.subscriptions {
+		sm := SubscriptionMetrics{Subject: subject}
+		if subscription != nil {
+			// closed subscriptions have nothing pending
+			if msgs, bytes, err := subscription.Pending(); err == nil {
+				sm.PendingMessages, sm.PendingBytes = msgs, bytes
+			}
+		}
+		m.Subscriptions = append(m.Subscriptions, sm)
+	}
+	for subject, in := range r.interests {
+		m.Handlers[subject] = len(in.clients)
+	}
+}
@@ -1,7 +1,9 @@
 package sniffer
 
 import (
+	"context"
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/nats-io/nats"
@@ -10,52 +12,102 @@ import (
 
 var (
 	ERR_NATS_CONN_CLOSED = errors.New("NATS connection is closed.")
+	ERR_INVALID_SUBJECT  = errors.New("Invalid subject.")
+	ERR_SNIFFER_STOPPED  = errors.New("Sniffer is stopped.")
+	ERR_SLOW_CONSUMER    = errors.New("Disconnected for being too slow.")
 )
 
-type SniffedMessageHandler func(msg string)
+// SniffedMessageHandler is called for every message arriving at a sniffed subject.
+type SniffedMessageHandler func(msg *SniffedMessage)
 
 // Sniffer subscribes to client-request NATS subjects and let them know
 // when new messages arrive.
 type Sniffer struct {
-	natsURL                 string
-	natsConn                *nats.Conn
-	subjectSubscriptionsMap *SubjectSubscriptionsMap
-	subjectHandlersMap      *SubjectHandlersMap
-	Quit                    chan struct{}
-}
+	natsURL   string
+	natsConn  *nats.Conn
+	ownsConn  bool
+	offline   bool
+	connMutex sync.RWMutex
+	registry  *subjectRegistry
+	statuses  *statusWatchers
+	// correlator, if set, pairs requests with their responses
+	correlator *correlator
+	totals     deliveryTotals
+	stopOnce   sync.Once
 
-// NewSniffer returns a new sniffer instance.
-func NewSniffer(url string) *Sniffer {
-	return &Sniffer{
-		natsURL:                 url,
-		subjectSubscriptionsMap: NewSubjectSubscriptionMap(),
-		subjectHandlersMap:      NewSubjectHandlersMap(),
-		Quit:                    make(chan struct{}),
-	}
-}
+	// discoveries feed subject trees, outside the registry
+	discoveries    []*discovery
+	discoveryMutex sync.Mutex
 
-// Start connects to the specified NATS server and starts managing
-// subject subscription and pumping data to registered clients
-func (s *Sniffer) Start() error {
-	var err error
+	// Quit stops the sniffer when closed. Prefer Stop, which also waits
+	// for in-flight handler calls.
+	Quit chan struct{}
 
-	// prepare NATS urls
-	servers := []string{"nats://" + s.natsURL}
+	// QueueSize is the number of messages buffered for each handler.
+	QueueSize int
+	// SlowConsumerPolicy tells what to do when a handler queue is full.
+	SlowConsumerPolicy SlowConsumerPolicy
+	// HistorySize and HistoryBytes bound the number of messages and payload
+	// bytes kept per sniffed subject for late-joining clients.
+	HistorySize  int
+	HistoryBytes int
 
-	// setup options to include all servers in the cluster
-	opts := nats.DefaultOptions
+	// User and Password, or Token, authenticate against NATS servers whose
+	// URL doesn't carry credentials.
+	User     string
+	Password string
+	Token    string
+	// CAFile is the CA certificate used to verify NATS servers, while
+	// CertFile and KeyFile hold the client certificate for mutual TLS.
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
 
-	// configure internal buffered chan; the default is 64k and
-	// we end up using too much memory because of that;
-	opts.SubChanLen = 8192
-	opts.Servers = servers
-	opts.MaxReconnect = 5
-	opts.ReconnectWait = (5 * time.Second)
+// NewSniffer returns a new sniffer instance. url is a comma separated list
+// of NATS servers, e.g. nats://host1:4222,tls://host2:4443, and is ignored
+// when an existing connection is given with WithConn.
+func NewSniffer(url string, options ...Option) *Sniffer {
+	s := &Sniffer{
+		natsURL:            url,
+		ownsConn:           true,
+		Quit:               make(chan struct{}),
+		QueueSize:          DefaultQueueSize,
+		SlowConsumerPolicy: DropOldest,
+		HistorySize:        DefaultHistorySize,
+		HistoryBytes:       DefaultHistoryBytes,
+		statuses:           newStatusWatchers(),
+	}
+	s.registry = newSubjectRegistry(s.subscribe, func() *history {
+		return newHistory(s.HistorySize, s.HistoryBytes)
+	})
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
 
-	// connect
-	s.natsConn, err = opts.Connect()
-	if err != nil {
-		return err
+// Start connects to the specified NATS servers and starts managing
+// subject subscription and pumping data to registered clients.
+// Should the connection be lost for good, a new one is created and
+// everything being sniffed is subscribed again. None of this applies
+// to a connection given with WithConn, which is used as is, nor to a
+// sniffer created WithoutConn.
+func (s *Sniffer) Start() error {
+	switch {
+	case s.offline:
+		s.statuses.set(&ConnectionStatus{State: Offline})
+	case s.ownsConn:
+		if err := s.connect(); err != nil {
+			return err
+		}
+	default:
+		s.statuses.set(&ConnectionStatus{State: Connected, Server: connectedServer(s.conn())})
+	}
+	if s.correlator != nil && !s.offline {
+		if err := s.correlator.watchInboxes(s.conn()); err != nil {
+			return err
+		}
 	}
 
 	go s.run()
@@ -64,75 +116,178 @@ func (s *Sniffer) Start() error {
 }
 
 func (s *Sniffer) run() {
-	// run cleanup periodically
-	cleanupTick := time.NewTicker(time.Second * 10)
-	for {
-		select {
-		case <-cleanupTick.C:
-			// look for subscribed subjects no one cares about anymore
-			for subject, subscribers := range s.subjectHandlersMap.Iter() {
-				if subscribers.Count() == 0 {
-					// remove subscription to subject
-					if subscription, ok := s.subjectSubscriptionsMap.Get(subject); ok {
-						subscription.Unsubscribe()
-						s.subjectSubscriptionsMap.Remove(subject)
-						s.subjectHandlersMap.Remove(subject)
-					}
-				}
-			}
-			break
-		case <-s.Quit:
-			cleanupTick.Stop()
-			s.natsConn.Close()
-			return
-		}
+	<-s.Quit
+	if s.ownsConn {
+		s.conn().Close()
 	}
 }
 
-// Sniff makes sure there's only on subscription per subject
-// Every time a new message arrives at one sniffed subject, registered
-// client handlers shall be called
-func (s *Sniffer) Sniff(subject string, msgHandler SniffedMessageHandler) (string, error) {
-	// is subject already being sniffed?
-	if !s.subjectSubscriptionsMap.Has(subject) {
-		// subject not being sniffed, so sniff
-		if s.natsConn.IsClosed() {
-			return "", ERR_NATS_CONN_CLOSED
+// Stop unsubscribes every sniffed subject, waits for in-flight handler
+// calls to return and closes the NATS connection. Handlers won't be called
+// once Stop returns, unless ctx is done first, in which case its error is
+// returned.
+func (s *Sniffer) Stop(ctx context.Context) error {
+	clients := s.registry.clear()
+	if s.correlator != nil {
+		s.correlator.clear()
+	}
+	s.undiscover()
+	if nc := s.conn(); nc != nil && !nc.IsClosed() {
+		if deadline, ok := ctx.Deadline(); ok {
+			nc.FlushTimeout(deadline.Sub(time.Now()))
+		} else {
+			nc.Flush()
+		}
+	}
+	s.stopOnce.Do(func() {
+		select {
+		case <-s.Quit:
+		default:
+			close(s.Quit)
 		}
+	})
 
-		// subscribe subject
-		subscription, err := s.natsConn.Subscribe(subject, func(m *nats.Msg) {
-			// call all message handlers interested in the incoming message
-			handlers, ok := s.subjectHandlersMap.Get(subject)
-			if ok {
-				for _, handlerFn := range handlers.Values() {
-					handlerFn(string(m.Data))
-				}
-			}
-		})
-		if err != nil {
-			return "", err
+	drained := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, c := range clients {
+			wg.Add(1)
+			go func(c *client) {
+				defer wg.Done()
+				c.stop()
+			}(c)
 		}
+		wg.Wait()
+		s.statuses.clear()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-		// store subject subscription
-		s.subjectSubscriptionsMap.Set(subject, subscription)
+// Sniff registers a handler to be called every time a new message arrives
+// at subject. Overlapping subjects share NATS subscriptions, so every
+// message is received only once no matter how many clients want it.
+// Each handler gets its own bounded queue and goroutine, so a slow handler
+// never holds back the others. With WithReplay, handlers first get recent
+// messages of subject, marked as historical.
+func (s *Sniffer) Sniff(subject string, msgHandler SniffedMessageHandler, options ...SniffOption) (string, error) {
+	opts := s.sniffOptions()
+	for _, option := range options {
+		option(&opts)
 	}
+	randomId, _, err := s.sniff(subject, msgHandler, opts)
+	return randomId, err
+}
 
-	// store subject subscription handler
-	handlers, ok := s.subjectHandlersMap.Get(subject)
-	if !ok {
-		handlers = NewHandlerMap()
+// sniff registers a new client for subject and returns its id.
+func (s *Sniffer) sniff(subject string, msgHandler SniffedMessageHandler, opts sniffOptions) (string, *client, error) {
+	if !ValidSubject(subject) {
+		return "", nil, ERR_INVALID_SUBJECT
 	}
+
 	randomId := uuid.NewV4().String()
-	handlers.Set(randomId, msgHandler)
-	s.subjectHandlersMap.Set(subject, handlers)
+	c := newClient(msgHandler, opts.queueSize, opts.policy, opts.filter)
+	c.totals = &s.totals
+	if err := s.registry.add(subject, randomId, c, opts.replay); err != nil {
+		c.stop()
+		return "", nil, err
+	}
+
+	return randomId, c, nil
+}
+
+// subscribe creates a NATS subscription feeding the registry. Without a
+// connection, there's nothing to subscribe to.
+func (s *Sniffer) subscribe(subject string) (*nats.Subscription, error) {
+	if s.offline {
+		return nil, nil
+	}
+	nc := s.conn()
+	if nc == nil || nc.IsClosed() {
+		return nil, ERR_NATS_CONN_CLOSED
+	}
 
-	return randomId, nil
+	return nc.Subscribe(subject, func(m *nats.Msg) {
+		msg := &SniffedMessage{
+			Subject:   m.Subject,
+			Reply:     m.Reply,
+			Data:      m.Data,
+			Size:      len(m.Data),
+			Timestamp: time.Now(),
+			ServerID:  nc.ConnectedServerId(),
+		}
+		if s.correlator != nil && msg.Reply != "" {
+			s.correlator.track(nc, msg)
+		}
+		s.registry.deliver(subject, msg)
+	})
+}
+
+// Inject delivers a message to the handlers of every sniffed subject
+// matching it, as if it had been received from NATS, and to the subject
+// trees discovering it. Along with WithoutConn, this sniffs recorded
+// traffic instead of live one.
+func (s *Sniffer) Inject(msg *SniffedMessage) {
+	s.registry.deliver("", msg)
+	s.discover(msg)
 }
 
+// Unsniff removes a handler, unsubscribing its subject if no one else is
+// sniffing it. Once Unsniff returns, the handler won't be called again.
 func (s *Sniffer) Unsniff(subject string, handlerId string) {
-	handlers, ok := s.subjectHandlersMap.Get(subject)
-	if ok {
-		handlers.Remove(handlerId)
+	if c, ok := s.registry.remove(subject, handlerId); ok {
+		c.stop()
+	}
+}
+
+// Done returns a channel that's closed when the handler stops receiving
+// messages, either because it was unsniffed or because it was disconnected
+// for being too slow.
+func (s *Sniffer) Done(subject string, handlerId string) <-chan struct{} {
+	if c, ok := s.client(subject, handlerId); ok {
+		return c.Done()
+	}
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+// Err returns why a handler stopped receiving messages, once Done is
+// closed: ERR_SLOW_CONSUMER if it was disconnected for being too slow,
+// ERR_SNIFFER_STOPPED if the sniffer stopped. It returns nil for handlers
+// still receiving messages or unsniffed.
+func (s *Sniffer) Err(subject string, handlerId string) error {
+	if c, ok := s.client(subject, handlerId); ok {
+		select {
+		case <-c.Done():
+			return c.Err()
+		default:
+			return nil
+		}
 	}
+	// Stop forgets handlers before stopping them
+	select {
+	case <-s.Quit:
+		return ERR_SNIFFER_STOPPED
+	default:
+		return nil
+	}
+}
+
+// ClientStats returns the delivery counters of a handler.
+func (s *Sniffer) ClientStats(subject string, handlerId string) (ClientStats, bool) {
+	if c, ok := s.client(subject, handlerId); ok {
+		return c.Stats(), true
+	}
+	return ClientStats{}, false
+}
+
+func (s *Sniffer) client(subject string, handlerId string) (*client, bool) {
+	return s.registry.get(subject, handlerId)
 }
@@ -0,0 +1,169 @@
+package sniffer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// watcherQueueSize is the number of status changes buffered per watcher.
+const watcherQueueSize = 16
+
+// ConnectionState is the state of the sniffer connection to NATS.
+type ConnectionState string
+
+const (
+	// Connected means the sniffer is connected and sniffing.
+	Connected ConnectionState = "connected"
+	// Disconnected means the connection was lost and the NATS client is
+	// trying to reconnect to one of the known servers.
+	Disconnected ConnectionState = "disconnected"
+	// Reconnected means the NATS client got a connection back.
+	Reconnected ConnectionState = "reconnected"
+	// Closed means the NATS client gave up on the connection.
+	Closed ConnectionState = "closed"
+	// Reconnecting means the sniffer is creating a new connection after
+	// the previous one was closed.
+	Reconnecting ConnectionState = "reconnecting"
+	// Offline means the sniffer has no NATS connection at all, and only
+	// sniffs injected messages.
+	Offline ConnectionState = "offline"
+)
+
+// ConnectionStatus describes a change of the sniffer connection state.
+type ConnectionStatus struct {
+	State     ConnectionState `json:"state"`
+	Server    string          `json:"server,omitempty"`
+	Attempt   int             `json:"attempt,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// StatusHandler is called every time the connection state changes.
+type StatusHandler func(status *ConnectionStatus)
+
+// watcher calls a status handler from its own goroutine, so that a slow
+// handler doesn't hold back the others.
+type watcher struct {
+	handler StatusHandler
+	queue   chan *ConnectionStatus
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+func newWatcher(handler StatusHandler) *watcher {
+	w := &watcher{
+		handler: handler,
+		queue:   make(chan *ConnectionStatus, watcherQueueSize),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *watcher) run() {
+	defer close(w.done)
+	for {
+		select {
+		case <-w.quit:
+			return
+		case status := <-w.queue:
+			w.handler(status)
+		}
+	}
+}
+
+// notify queues a status change, dropping it if the watcher is too slow.
+func (w *watcher) notify(status *ConnectionStatus) {
+	select {
+	case w.queue <- status:
+	default:
+	}
+}
+
+// stop stops the watcher and waits until no handler call is in flight.
+func (w *watcher) stop() {
+	close(w.quit)
+	<-w.done
+}
+
+// statusWatchers keeps the current connection status and everyone
+// watching it.
+type statusWatchers struct {
+	status   *ConnectionStatus
+	watchers map[string]*watcher
+	mutex    sync.RWMutex
+
+	// reconnects counts the connections got back, either by the NATS
+	// client or by creating a new one
+	reconnects uint64
+}
+
+func newStatusWatchers() *statusWatchers {
+	return &statusWatchers{
+		status:   &ConnectionStatus{State: Closed, Timestamp: time.Now()},
+		watchers: make(map[string]*watcher),
+	}
+}
+
+// set records a new status and notifies every watcher.
+func (sw *statusWatchers) set(status *ConnectionStatus) {
+	status.Timestamp = time.Now()
+
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+
+	if status.State == Reconnected || (status.State == Connected && sw.status.State == Reconnecting) {
+		sw.reconnects++
+	}
+	sw.status = status
+	for _, w := range sw.watchers {
+		w.notify(status)
+	}
+}
+
+// clear stops and removes every watcher.
+func (sw *statusWatchers) clear() {
+	sw.mutex.Lock()
+	watchers := sw.watchers
+	sw.watchers = make(map[string]*watcher)
+	sw.mutex.Unlock()
+
+	for _, w := range watchers {
+		w.stop()
+	}
+}
+
+// Watch registers a handler to be called every time the NATS connection
+// state changes. It returns an id to be passed to Unwatch.
+func (s *Sniffer) Watch(handler StatusHandler) string {
+	id := uuid.NewV4().String()
+
+	s.statuses.mutex.Lock()
+	defer s.statuses.mutex.Unlock()
+	s.statuses.watchers[id] = newWatcher(handler)
+
+	return id
+}
+
+// Unwatch removes a status handler. Once Unwatch returns, the handler won't
+// be called again.
+func (s *Sniffer) Unwatch(id string) {
+	s.statuses.mutex.Lock()
+	w, ok := s.statuses.watchers[id]
+	delete(s.statuses.watchers, id)
+	s.statuses.mutex.Unlock()
+
+	if ok {
+		w.stop()
+	}
+}
+
+// Status returns the current state of the NATS connection.
+func (s *Sniffer) Status() ConnectionStatus {
+	s.statuses.mutex.RLock()
+	defer s.statuses.mutex.RUnlock()
+	return *s.statuses.status
+}
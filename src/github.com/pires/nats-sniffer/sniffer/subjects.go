@@ -0,0 +1,61 @@
+package sniffer
+
+import (
+	"strings"
+)
+
+const (
+	tokenSeparator    = "."
+	partialWildcard   = "*"
+	fullWildcard      = ">"
+	subjectWhitespace = " \t\r\n"
+)
+
+// ValidSubject tells whether subject is a valid NATS subject, possibly with
+// wildcards. Wildcards must be whole tokens and > may only come last.
+func ValidSubject(subject string) bool {
+	if subject == "" || strings.ContainsAny(subject, subjectWhitespace) {
+		return false
+	}
+	tokens := strings.Split(subject, tokenSeparator)
+	for i, token := range tokens {
+		switch {
+		case token == "":
+			return false
+		case token == fullWildcard:
+			if i != len(tokens)-1 {
+				return false
+			}
+		case token != partialWildcard && strings.ContainsAny(token, partialWildcard+fullWildcard):
+			return false
+		}
+	}
+	return true
+}
+
+// SubjectCovers tells whether every subject matched by pattern b is also
+// matched by pattern a, following NATS token and wildcard semantics. A
+// literal subject is covered by a pattern exactly when the pattern matches
+// it.
+func SubjectCovers(a string, b string) bool {
+	at := strings.Split(a, tokenSeparator)
+	bt := strings.Split(b, tokenSeparator)
+	for i, token := range at {
+		if token == fullWildcard {
+			// > needs at least one more token
+			return len(bt) > i
+		}
+		if i >= len(bt) {
+			return false
+		}
+		switch {
+		case token == partialWildcard:
+			if bt[i] == fullWildcard {
+				return false
+			}
+		case token != bt[i]:
+			return false
+		}
+	}
+	return len(at) == len(bt)
+}
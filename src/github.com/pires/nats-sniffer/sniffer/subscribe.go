@@ -0,0 +1,53 @@
+package sniffer
+
+import (
+	"context"
+)
+
+// Subscribe sniffs subject until ctx is done. Messages are delivered on
+// the returned channel, which is closed when the subscription ends. If it
+// ends for any other reason than ctx being done, e.g. the subject is
+// invalid or the subscriber is too slow, the error is delivered on the
+// error channel. Both channels are closed when the subscription ends.
+func (s *Sniffer) Subscribe(ctx context.Context, subject string, options ...SniffOption) (<-chan *SniffedMessage, <-chan error) {
+	opts := s.sniffOptions()
+	for _, option := range options {
+		option(&opts)
+	}
+
+	msgs := make(chan *SniffedMessage)
+	errs := make(chan error, 1)
+
+	id, c, err := s.sniff(subject, func(msg *SniffedMessage) {
+		select {
+		case msgs <- msg:
+		case <-ctx.Done():
+		}
+	}, opts)
+	if err != nil {
+		errs <- err
+		close(errs)
+		close(msgs)
+		return msgs, errs
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-c.Done():
+		}
+		s.Unsniff(subject, id)
+
+		if ctx.Err() == nil {
+			if err := c.Err(); err != nil {
+				errs <- err
+			} else {
+				errs <- ERR_SNIFFER_STOPPED
+			}
+		}
+		close(errs)
+		close(msgs)
+	}()
+
+	return msgs, errs
+}
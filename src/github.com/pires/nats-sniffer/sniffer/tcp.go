@@ -0,0 +1,224 @@
+package sniffer
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+)
+
+// maxPendingBytes bounds the out of order data buffered per TCP stream
+// while waiting for missing segments. Past it, the missing data is given
+// up on.
+const maxPendingBytes = 4 << 20
+
+// TCP flags.
+const (
+	tcpFin = 0x01
+	tcpSyn = 0x02
+	tcpRst = 0x04
+)
+
+// tcpSegment is a TCP segment decoded from a captured packet.
+type tcpSegment struct {
+	src     string
+	dst     string
+	srcPort int
+	dstPort int
+	seq     uint32
+	flags   byte
+	payload []byte
+}
+
+// decodeSegment decodes the TCP segment carried by a packet, if any.
+// Fragmented IP packets are not reassembled.
+func decodeSegment(p *packet) (*tcpSegment, bool) {
+	data := p.data
+	switch p.linkType {
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+		// skip VLAN tags
+		for etherType == 0x8100 || etherType == 0x88a8 {
+			if len(data) < 4 {
+				return nil, false
+			}
+			etherType = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return nil, false
+		}
+	case linkTypeNull, linkTypeLoop:
+		if len(data) < 4 {
+			return nil, false
+		}
+		data = data[4:]
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		data = data[16:]
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	default:
+		return nil, false
+	}
+	if len(data) == 0 {
+		return nil, false
+	}
+
+	var src, dst net.IP
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return nil, false
+		}
+		headerLength := int(data[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(data[2:]))
+		fragment := binary.BigEndian.Uint16(data[6:])
+		if data[9] != 6 || fragment&0x3fff != 0 || headerLength < 20 || total < headerLength || total > len(data) {
+			return nil, false
+		}
+		src, dst = net.IP(data[12:16]), net.IP(data[16:20])
+		data = data[headerLength:total]
+	case 6:
+		if len(data) < 40 {
+			return nil, false
+		}
+		total := 40 + int(binary.BigEndian.Uint16(data[4:]))
+		if data[6] != 6 || total > len(data) {
+			return nil, false
+		}
+		src, dst = net.IP(data[8:24]), net.IP(data[24:40])
+		data = data[40:total]
+	default:
+		return nil, false
+	}
+
+	if len(data) < 20 {
+		return nil, false
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < 20 || offset > len(data) {
+		return nil, false
+	}
+	s := &tcpSegment{
+		srcPort: int(binary.BigEndian.Uint16(data)),
+		dstPort: int(binary.BigEndian.Uint16(data[2:])),
+		seq:     binary.BigEndian.Uint32(data[4:]),
+		flags:   data[13],
+		payload: data[offset:],
+	}
+	s.src = net.JoinHostPort(src.String(), strconv.Itoa(s.srcPort))
+	s.dst = net.JoinHostPort(dst.String(), strconv.Itoa(s.dstPort))
+	return s, true
+}
+
+// tcpFlow is one direction of a TCP connection.
+type tcpFlow struct {
+	src string
+	dst string
+}
+
+// tcpStream puts the segments of a flow back in order, handing the data
+// they carry to a protocol parser. Retransmitted data is dropped.
+type tcpStream struct {
+	parser  *ProtocolParser
+	started bool
+	next    uint32
+	pending map[uint32][]byte
+	bytes   int
+	// syncing is set while looking for the start of an operation, after
+	// joining a connection midway
+	syncing bool
+	// lost is set once the stream can't be decoded anymore
+	lost bool
+}
+
+func newTCPStream(parser *ProtocolParser) *tcpStream {
+	return &tcpStream{
+		parser:  parser,
+		pending: make(map[uint32][]byte),
+	}
+}
+
+// add hands a segment to the stream, parsing whatever data is now in
+// order.
+func (ts *tcpStream) add(s *tcpSegment, timestamp time.Time) {
+	if ts.lost {
+		return
+	}
+	if s.flags&tcpSyn != 0 {
+		ts.started = true
+		ts.next = s.seq + 1
+		return
+	}
+	if !ts.started {
+		// joined the connection midway
+		ts.started = true
+		ts.syncing = true
+		ts.next = s.seq
+	}
+	if len(s.payload) == 0 {
+		return
+	}
+	if ts.syncing {
+		if int32(s.seq-ts.next) < 0 || !startsOperation(s.payload) {
+			ts.next = s.seq + uint32(len(s.payload))
+			return
+		}
+		ts.syncing = false
+		ts.next = s.seq
+	}
+
+	if int32(s.seq-ts.next) > 0 {
+		if _, ok := ts.pending[s.seq]; !ok {
+			ts.pending[s.seq] = s.payload
+			ts.bytes += len(s.payload)
+		}
+		if ts.bytes > maxPendingBytes {
+			ts.lost = true
+			ts.pending = nil
+		}
+		return
+	}
+	ts.deliver(s.seq, s.payload, timestamp)
+
+	// segments that arrived early may now be in order
+	for len(ts.pending) > 0 {
+		delivered := false
+		for seq, payload := range ts.pending {
+			if int32(seq-ts.next) <= 0 {
+				delete(ts.pending, seq)
+				ts.bytes -= len(payload)
+				ts.deliver(seq, payload, timestamp)
+				delivered = true
+			}
+		}
+		if !delivered {
+			break
+		}
+	}
+}
+
+// deliver parses the part of a payload starting at seq that wasn't parsed
+// already.
+func (ts *tcpStream) deliver(seq uint32, payload []byte, timestamp time.Time) {
+	if ts.lost {
+		return
+	}
+	if seen := int(ts.next - seq); seen > 0 {
+		if seen >= len(payload) {
+			return
+		}
+		payload = payload[seen:]
+	}
+	ts.next += uint32(len(payload))
+	if err := ts.parser.Parse(payload, timestamp); err != nil {
+		ts.lost = true
+		ts.pending = nil
+	}
+}
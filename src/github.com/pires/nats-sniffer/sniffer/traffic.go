@@ -0,0 +1,220 @@
+package sniffer
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// trafficResolution is the duration of the buckets traffic is counted
+	// in, and so how precise windows are.
+	trafficResolution = 10 * time.Second
+	// trafficBuckets covers the longest window.
+	trafficBuckets = int(15 * time.Minute / trafficResolution)
+)
+
+// TrafficWindows are the sliding windows traffic statistics cover, along
+// with their names.
+var TrafficWindows = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", 5 * time.Minute},
+	{"15m", 15 * time.Minute},
+}
+
+// sizeBounds are the upper bounds of the payload size histogram buckets,
+// the last bucket holding anything bigger.
+var sizeBounds = [...]int{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+// TrafficStats describes the traffic of a sniffed subject since it was
+// first sniffed, and over every window of TrafficWindows.
+type TrafficStats struct {
+	Subject  string    `json:"subject"`
+	Since    time.Time `json:"since"`
+	Messages uint64    `json:"messages"`
+	Bytes    uint64    `json:"bytes"`
+	// Windows maps window names, e.g. 1m, to the traffic over them.
+	Windows map[string]*TrafficWindow `json:"windows"`
+}
+
+// TrafficWindow describes the traffic of a subject over a window, which
+// is shorter for subjects sniffed more recently than that. Durations are
+// in nanoseconds.
+type TrafficWindow struct {
+	Messages        uint64        `json:"messages"`
+	Bytes           uint64        `json:"bytes"`
+	MessageRate     float64       `json:"messages_per_second"`
+	ByteRate        float64       `json:"bytes_per_second"`
+	MinSize         int           `json:"min_size"`
+	AvgSize         float64       `json:"avg_size"`
+	MaxSize         int           `json:"max_size"`
+	MinInterArrival time.Duration `json:"min_inter_arrival_ns"`
+	AvgInterArrival time.Duration `json:"avg_inter_arrival_ns"`
+	MaxInterArrival time.Duration `json:"max_inter_arrival_ns"`
+	Sizes           []SizeBucket  `json:"sizes"`
+}
+
+// SizeBucket counts the payloads of at most Max bytes that don't fit a
+// smaller bucket. The last bucket has no Max.
+type SizeBucket struct {
+	Max   int    `json:"max,omitempty"`
+	Count uint64 `json:"count"`
+}
+
+// traffic counts the messages of a sniffed subject in a ring of buckets,
+// each covering trafficResolution.
+type traffic struct {
+	since    time.Time
+	messages uint64
+	bytes    uint64
+	last     time.Time
+	buckets  [trafficBuckets]trafficBucket
+	mutex    sync.Mutex
+}
+
+type trafficBucket struct {
+	// slot numbers the bucket since the epoch, telling stale ones apart
+	slot     int64
+	messages uint64
+	bytes    uint64
+	minSize  int
+	maxSize  int
+	gaps     uint64
+	gapSum   time.Duration
+	minGap   time.Duration
+	maxGap   time.Duration
+	sizes    [len(sizeBounds) + 1]uint64
+}
+
+func newTraffic(since time.Time) *traffic {
+	return &traffic{since: since}
+}
+
+// add counts a message arrived at now.
+func (t *traffic) add(msg *SniffedMessage, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.messages++
+	t.bytes += uint64(msg.Size)
+
+	slot := now.UnixNano() / int64(trafficResolution)
+	b := &t.buckets[slot%int64(trafficBuckets)]
+	if b.slot != slot || b.messages == 0 {
+		*b = trafficBucket{slot: slot, minSize: msg.Size, maxSize: msg.Size}
+	}
+	b.messages++
+	b.bytes += uint64(msg.Size)
+	if msg.Size < b.minSize {
+		b.minSize = msg.Size
+	}
+	if msg.Size > b.maxSize {
+		b.maxSize = msg.Size
+	}
+	i := 0
+	for i < len(sizeBounds) && msg.Size > sizeBounds[i] {
+		i++
+	}
+	b.sizes[i]++
+
+	if !t.last.IsZero() {
+		gap := now.Sub(t.last)
+		if b.gaps == 0 || gap < b.minGap {
+			b.minGap = gap
+		}
+		if gap > b.maxGap {
+			b.maxGap = gap
+		}
+		b.gaps++
+		b.gapSum += gap
+	}
+	t.last = now
+}
+
+// snapshot describes the traffic of subject as of now.
+func (t *traffic) snapshot(subject string, now time.Time) TrafficStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	stats := TrafficStats{
+		Subject:  subject,
+		Since:    t.since,
+		Messages: t.messages,
+		Bytes:    t.bytes,
+		Windows:  make(map[string]*TrafficWindow),
+	}
+	current := now.UnixNano() / int64(trafficResolution)
+	for _, window := range TrafficWindows {
+		w := &TrafficWindow{Sizes: make([]SizeBucket, len(sizeBounds)+1)}
+		for i := range w.Sizes {
+			if i < len(sizeBounds) {
+				w.Sizes[i].Max = sizeBounds[i]
+			}
+		}
+
+		var gaps uint64
+		var gapSum time.Duration
+		oldest := current - int64(window.Duration/trafficResolution) + 1
+		for i := range t.buckets {
+			b := &t.buckets[i]
+			if b.messages == 0 || b.slot < oldest || b.slot > current {
+				continue
+			}
+			if w.Messages == 0 || b.minSize < w.MinSize {
+				w.MinSize = b.minSize
+			}
+			if b.maxSize > w.MaxSize {
+				w.MaxSize = b.maxSize
+			}
+			if b.gaps > 0 && (gaps == 0 || b.minGap < w.MinInterArrival) {
+				w.MinInterArrival = b.minGap
+			}
+			if b.maxGap > w.MaxInterArrival {
+				w.MaxInterArrival = b.maxGap
+			}
+			w.Messages += b.messages
+			w.Bytes += b.bytes
+			gaps += b.gaps
+			gapSum += b.gapSum
+			for j, count := range b.sizes {
+				w.Sizes[j].Count += count
+			}
+		}
+
+		// the oldest bucket started a bit less than window ago, and subjects
+		// sniffed for less than that are rated over their age
+		elapsed := now.Sub(time.Unix(0, oldest*int64(trafficResolution)))
+		if age := now.Sub(t.since); age < elapsed {
+			elapsed = age
+		}
+		if elapsed > 0 {
+			w.MessageRate = float64(w.Messages) / elapsed.Seconds()
+			w.ByteRate = float64(w.Bytes) / elapsed.Seconds()
+		}
+		if w.Messages > 0 {
+			w.AvgSize = float64(w.Bytes) / float64(w.Messages)
+		}
+		if gaps > 0 {
+			w.AvgInterArrival = gapSum / time.Duration(gaps)
+		}
+		stats.Windows[window.Name] = w
+	}
+	return stats
+}
+
+// TrafficStats returns the traffic statistics of every sniffed subject.
+func (s *Sniffer) TrafficStats() map[string]TrafficStats {
+	stats := make(map[string]TrafficStats)
+	for _, st := range s.registry.trafficStats() {
+		stats[st.Subject] = st
+	}
+	return stats
+}
+
+// SubjectTrafficStats returns the traffic statistics of a sniffed subject,
+// e.g. device.>, or false if it isn't sniffed.
+func (s *Sniffer) SubjectTrafficStats(subject string) (TrafficStats, bool) {
+	return s.registry.subjectTrafficStats(subject)
+}
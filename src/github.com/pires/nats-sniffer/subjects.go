@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// sniffGroup sniffs several subjects on behalf of a single client, which
+// gets the union of their messages, each of them once.
+type sniffGroup struct {
+	sniffer  *sniffer.Sniffer
+	subjects []string
+	ids      []string
+}
+
+// newSniffGroup returns a group sniffing the given subjects, in order,
+// leaving out duplicates and subjects covered by another one, which would
+// deliver the same messages twice.
+func newSniffGroup(s *sniffer.Sniffer, subjects []string) (*sniffGroup, error) {
+	if len(subjects) == 0 {
+		return nil, sniffer.ERR_INVALID_SUBJECT
+	}
+	for _, subject := range subjects {
+		if !sniffer.ValidSubject(subject) {
+			return nil, fmt.Errorf("Invalid subject [%s].", subject)
+		}
+	}
+
+	g := &sniffGroup{sniffer: s}
+	for i, subject := range subjects {
+		redundant := false
+		for j, other := range subjects {
+			if sniffer.SubjectCovers(other, subject) && (other != subject || j < i) {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			g.subjects = append(g.subjects, subject)
+		}
+	}
+	return g, nil
+}
+
+// sniff sniffs every subject, calling handler with the index of the
+// subject each message was sniffed for. Messages of subjects overlapping
+// without covering each other, e.g. foo.* and *.bar, are sniffed for the
+// first one alone. replays holds the replay of each subject. Should
+// sniffing any subject fail, none is sniffed.
+func (g *sniffGroup) sniff(handler func(i int, msg *sniffer.SniffedMessage), replays []sniffer.Replay, options ...sniffer.SniffOption) error {
+	for i, subject := range g.subjects {
+		i := i
+		opts := append([]sniffer.SniffOption{sniffer.WithReplay(replays[i])}, options...)
+		id, err := g.sniffer.Sniff(subject, func(msg *sniffer.SniffedMessage) {
+			if g.first(msg.Subject) == i {
+				handler(i, msg)
+			}
+		}, opts...)
+		if err != nil {
+			g.unsniff()
+			return err
+		}
+		g.ids = append(g.ids, id)
+	}
+	return nil
+}
+
+// first returns the index of the first subject matching a message subject.
+func (g *sniffGroup) first(subject string) int {
+	for i, s := range g.subjects {
+		if sniffer.SubjectCovers(s, subject) {
+			return i
+		}
+	}
+	return -1
+}
+
+// unsniff stops sniffing every subject.
+func (g *sniffGroup) unsniff() {
+	for i, id := range g.ids {
+		g.sniffer.Unsniff(g.subjects[i], id)
+	}
+	g.ids = nil
+}
+
+// done returns a channel that's closed once the sniffer stops delivering
+// any of the subjects, e.g. for the client being too slow. err tells why.
+func (g *sniffGroup) done() <-chan struct{} {
+	done := make(chan struct{})
+	var once sync.Once
+	for i, id := range g.ids {
+		go func(subjectDone <-chan struct{}) {
+			<-subjectDone
+			once.Do(func() { close(done) })
+		}(g.sniffer.Done(g.subjects[i], id))
+	}
+	return done
+}
+
+// err returns why the sniffer stopped delivering a subject, once done is
+// closed.
+func (g *sniffGroup) err() error {
+	for i, id := range g.ids {
+		if err := g.sniffer.Err(g.subjects[i], id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stats returns the delivery counters of every subject added up.
+func (g *sniffGroup) stats() sniffer.ClientStats {
+	var total sniffer.ClientStats
+	for i, id := range g.ids {
+		if stats, ok := g.sniffer.ClientStats(g.subjects[i], id); ok {
+			total.Delivered += stats.Delivered
+			total.Dropped += stats.Dropped
+			total.Filtered += stats.Filtered
+			total.Pending += stats.Pending
+		}
+	}
+	return total
+}
+
+// traffic returns the traffic statistics of every subject.
+func (g *sniffGroup) traffic() []sniffer.TrafficStats {
+	var traffic []sniffer.TrafficStats
+	for _, subject := range g.subjects {
+		if stats, ok := g.sniffer.SubjectTrafficStats(subject); ok {
+			traffic = append(traffic, stats)
+		}
+	}
+	return traffic
+}
+
+// covers tells whether messages of subject are sniffed for the group.
+func (g *sniffGroup) covers(subject string) bool {
+	for _, s := range g.subjects {
+		if sniffer.SubjectCovers(s, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *sniffGroup) String() string {
+	return strings.Join(g.subjects, ",")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gnatsd "github.com/nats-io/gnatsd/test"
+	natsclient "github.com/nats-io/nats"
+	"github.com/pires/nats-sniffer/sniffer"
+)
+
+// testPort is where tests run NATS, apart from the sniffer package tests.
+const testPort = 8423
+
+func TestSniffGroup(t *testing.T) {
+	s := sniffer.NewSniffer("", sniffer.WithoutConn())
+	s.Start()
+	defer s.Stop(context.Background())
+
+	g, err := newSniffGroup(s, []string{"device.*.connection", "device.>", "other", "device.>"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.String() != "device.>,other" {
+		t.Errorf("Expected covered subjects to be left out, got [%s]", g)
+	}
+	if _, err := newSniffGroup(s, []string{"device..x"}); err == nil {
+		t.Error("Expected invalid subjects to be refused")
+	}
+
+	// overlapping subjects deliver shared messages once
+	g, err = newSniffGroup(s, []string{"foo.*", "*.bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 8)
+	if err := g.sniff(func(i int, msg *sniffer.SniffedMessage) {
+		received <- fmt.Sprintf("%d %s", i, msg.Subject)
+	}, make([]sniffer.Replay, 2)); err != nil {
+		t.Fatal(err)
+	}
+	defer g.unsniff()
+	for _, subject := range []string{"foo.bar", "foo.x", "y.bar"} {
+		s.Inject(&sniffer.SniffedMessage{Subject: subject, Timestamp: time.Now()})
+	}
+	got := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case r := <-received:
+			got[r] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for messages, got %v", got)
+		}
+	}
+	select {
+	case r := <-received:
+		t.Errorf("Expected every message once, got %v and %s", got, r)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if !got["0 foo.bar"] || !got["0 foo.x"] || !got["1 y.bar"] {
+		t.Errorf("Unexpected messages: %v", got)
+	}
+}
+
+// Should sniffing a subject fail after another one replayed its history,
+// the replayed messages must not keep the group from unsniffing.
+func TestSniffGroupPartialFailure(t *testing.T) {
+	opts := gnatsd.DefaultTestOptions
+	opts.Port = testPort
+	srv := gnatsd.RunServer(&opts)
+	defer srv.Shutdown()
+	nc, err := natsclient.Connect(fmt.Sprintf("nats://localhost:%d", testPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := sniffer.NewSniffer("", sniffer.WithConn(nc))
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.Background())
+	b := NewBroker(s)
+	web := httptest.NewServer(b)
+	defer web.Close()
+	defer b.Shutdown()
+
+	// a.x has history and needs no new subscription, unlike b.y
+	if _, err := s.Sniff("a.x", func(msg *sniffer.SniffedMessage) {}); err != nil {
+		t.Fatal(err)
+	}
+	s.Inject(&sniffer.SniffedMessage{Subject: "a.x", Data: []byte("A"), Size: 1, Timestamp: time.Now()})
+	nc.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, path := range []string{"/sniff/", "/sniff.ndjson"} {
+		resp, err := client.Get(web.URL + path + "?subject=a.x&subject=b.y&history=1")
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s: expected %d, got %d", path, http.StatusServiceUnavailable, resp.StatusCode)
+		}
+	}
+
+	// replayed messages are held until the stream begins
+	resp, err := client.Get(web.URL + "/sniff.ndjson?subject=a.x&history=1&limit=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var msg map[string]interface{}
+	line, err := bufio.NewReader(resp.Body).ReadBytes('\n')
+	if err != nil || json.Unmarshal(line, &msg) != nil || msg["payload"] != "A" || msg["historical"] != true {
+		t.Errorf("Expected the replayed message, got %q %v", line, err)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ServeStats handles GET /stats, returning the traffic statistics of every
+// sniffed subject, and GET /stats/<subject>, returning those of a single
+// one, e.g. /stats/device.>.
+func (b *Broker) ServeStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	subject := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/stats"), "/")
+	if subject == "" {
+		writeJSON(w, http.StatusOK, b.sniffer.TrafficStats())
+		return
+	}
+	stats, ok := b.sniffer.SubjectTrafficStats(subject)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Subject [%s] isn't being sniffed.", subject), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, &stats)
+}
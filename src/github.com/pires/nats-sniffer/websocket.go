@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ERR_WEBSOCKET_PROTOCOL = errors.New("WebSocket protocol error.")
+	ERR_WEBSOCKET_TOO_BIG  = errors.New("WebSocket message is too big.")
+	ERR_WEBSOCKET_CLOSED   = errors.New("WebSocket is closed.")
+)
+
+// websocketGUID is hashed along with the client key to accept a handshake,
+// as per RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// WebSocket close codes.
+const (
+	closeNormal        = 1000
+	closeGoingAway     = 1001
+	closeProtocolError = 1002
+	closePolicy        = 1008
+	closeTooBig        = 1009
+)
+
+const (
+	// maxWebSocketMessage bounds messages sent by clients, which are
+	// only ever small commands.
+	maxWebSocketMessage = 64 << 10
+	// webSocketWriteTimeout bounds every write, so that a stuck client
+	// doesn't block its writers forever.
+	webSocketWriteTimeout = 10 * time.Second
+)
+
+// websocket is the server side of a WebSocket connection. It implements
+// just enough of RFC 6455 to exchange JSON with browsers: no extensions
+// and no subprotocols. Frames may be written from several goroutines.
+type websocket struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// readTimeout, if positive, bounds the wait for every frame. Clients
+	// answer pings, so this detects dead peers.
+	readTimeout time.Duration
+	closeSent   bool
+	closeOnce   sync.Once
+	writeMutex  sync.Mutex
+}
+
+// upgradeWebSocket takes over an HTTP connection for the WebSocket
+// protocol. Should the handshake fail, the client gets an HTTP error.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*websocket, error) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return nil, fmt.Errorf("Unexpected method [%s]", r.Method)
+	}
+	if !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket upgrade.", http.StatusBadRequest)
+		return nil, errors.New("Not a WebSocket upgrade")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version.", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("Unsupported WebSocket version [%s]", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Missing WebSocket key.", http.StatusBadRequest)
+		return nil, errors.New("Missing WebSocket key")
+	}
+	// browsers don't apply the same-origin policy to WebSockets, so
+	// don't let other sites sniff on behalf of their visitors
+	if origin := r.Header.Get("Origin"); origin != "" {
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "Cross-origin WebSockets are not allowed.", http.StatusForbidden)
+			return nil, fmt.Errorf("Cross-origin request from [%s]", origin)
+		}
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSockets unsupported!", http.StatusInternalServerError)
+		return nil, errors.New("Connection can't be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(hash[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &websocket{conn: conn, r: rw.Reader}, nil
+}
+
+// headerHas tells whether a comma separated header holds token.
+func headerHas(h http.Header, name string, token string) bool {
+	for _, value := range h[name] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage returns the next text or binary message, answering pings
+// on the way. It returns io.EOF once the client closes the connection.
+func (ws *websocket) readMessage() (int, []byte, error) {
+	var message []byte
+	opcode := -1
+	for {
+		fin, op, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case opPing:
+			if err := ws.writeFrame(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			// echo the close code, as the protocol requires
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			ws.writeFrame(opClose, payload)
+			return 0, nil, io.EOF
+		case opContinuation:
+			if opcode < 0 {
+				return 0, nil, ERR_WEBSOCKET_PROTOCOL
+			}
+		case opText, opBinary:
+			if opcode >= 0 {
+				return 0, nil, ERR_WEBSOCKET_PROTOCOL
+			}
+			opcode = op
+		default:
+			return 0, nil, ERR_WEBSOCKET_PROTOCOL
+		}
+
+		if len(message)+len(payload) > maxWebSocketMessage {
+			return 0, nil, ERR_WEBSOCKET_TOO_BIG
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads a single frame and unmasks its payload.
+func (ws *websocket) readFrame() (bool, int, []byte, error) {
+	if ws.readTimeout > 0 {
+		ws.conn.SetReadDeadline(time.Now().Add(ws.readTimeout))
+	}
+
+	var header [2]byte
+	if _, err := io.ReadFull(ws.r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	op := int(header[0] & 0x0f)
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	// no extensions were negotiated, and clients must mask every frame
+	if header[0]&0x70 != 0 || !masked {
+		return false, 0, nil, ERR_WEBSOCKET_PROTOCOL
+	}
+
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(ws.r, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(ws.r, b[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	if op >= opClose && (!fin || length > 125) {
+		return false, 0, nil, ERR_WEBSOCKET_PROTOCOL
+	}
+	if length > maxWebSocketMessage {
+		return false, 0, nil, ERR_WEBSOCKET_TOO_BIG
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, op, payload, nil
+}
+
+// writeJSON sends v as a JSON text message.
+func (ws *websocket) writeJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ws.writeFrame(opText, data)
+}
+
+// ping asks the client to prove it's still there.
+func (ws *websocket) ping() error {
+	return ws.writeFrame(opPing, nil)
+}
+
+// writeFrame sends a single unmasked frame. Nothing is sent after a close
+// frame.
+func (ws *websocket) writeFrame(op int, payload []byte) error {
+	ws.writeMutex.Lock()
+	defer ws.writeMutex.Unlock()
+
+	if ws.closeSent {
+		return ERR_WEBSOCKET_CLOSED
+	}
+	if op == opClose {
+		ws.closeSent = true
+	}
+
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|byte(op))
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(n))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	ws.conn.SetWriteDeadline(time.Now().Add(webSocketWriteTimeout))
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// close sends a close frame, unless one was sent already, and closes the
+// connection.
+func (ws *websocket) close(code int, reason string) {
+	ws.closeOnce.Do(func() {
+		payload := make([]byte, 2, 2+len(reason))
+		binary.BigEndian.PutUint16(payload, uint16(code))
+		ws.writeFrame(opClose, append(payload, reason...))
+		ws.conn.Close()
+	})
+}
+
+// closeCode returns the close code telling a client why reading failed.
+func closeCode(err error) int {
+	switch err {
+	case ERR_WEBSOCKET_PROTOCOL:
+		return closeProtocolError
+	case ERR_WEBSOCKET_TOO_BIG:
+		return closeTooBig
+	}
+	return closeNormal
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientFrame builds a frame as sent by a client, masked unless told
+// otherwise.
+func clientFrame(fin bool, op int, payload []byte, masked bool) []byte {
+	frame := []byte{byte(op)}
+	if fin {
+		frame[0] |= 0x80
+	}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126, byte(n>>8), byte(n))
+	default:
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(n))
+		frame = append(frame, maskBit|127)
+		frame = append(frame, b[:]...)
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readServerFrame reads an unmasked frame sent by the server.
+func readServerFrame(r *bufio.Reader) (int, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(b[:])
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(r, payload)
+	return int(header[0] & 0x0f), payload, err
+}
+
+// wsPipe returns the server side of a WebSocket over a pipe, along with
+// the client end.
+func wsPipe() (*websocket, net.Conn) {
+	server, client := net.Pipe()
+	return &websocket{conn: server, r: bufio.NewReader(server)}, client
+}
+
+// wsClient is the client side of a WebSocket to a test server.
+type wsClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// wsTestEvent is a wsEvent as received by a client.
+type wsTestEvent struct {
+	Type    string                 `json:"type"`
+	Command string                 `json:"command"`
+	Subject string                 `json:"subject"`
+	Message map[string]interface{} `json:"message"`
+	Error   string                 `json:"error"`
+	Reason  string                 `json:"reason"`
+}
+
+// handshake sends a WebSocket upgrade request for path to addr, with the
+// given header values, and returns the response.
+func handshake(t *testing.T, addr string, path string, header map[string]string) (*http.Response, net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+path, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for name, value := range header {
+		if value == "" {
+			req.Header.Del(name)
+		} else {
+			req.Header.Set(name, value)
+		}
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, conn, r
+}
+
+// dialWebSocket opens a WebSocket to the /ws endpoint of a test server.
+func dialWebSocket(t *testing.T, serverURL string) *wsClient {
+	resp, conn, r := handshake(t, strings.TrimPrefix(serverURL, "http://"), "/ws", nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected a WebSocket upgrade, got %d", resp.StatusCode)
+	}
+	return &wsClient{conn: conn, r: r}
+}
+
+// send sends a command.
+func (c *wsClient) send(t *testing.T, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.conn.Write(clientFrame(true, opText, data, true)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// event returns the next event, skipping pings and stats, or nil once the
+// server closes the WebSocket.
+func (c *wsClient) event(t *testing.T) *wsTestEvent {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		op, payload, err := readServerFrame(c.r)
+		if err != nil {
+			t.Fatalf("Error reading event: %v", err)
+		}
+		switch op {
+		case opClose:
+			return nil
+		case opText:
+			e := &wsTestEvent{}
+			if err := json.Unmarshal(payload, e); err != nil {
+				t.Fatal(err)
+			}
+			if e.Type != statsEvent {
+				return e
+			}
+		}
+	}
+}
+
+// expect returns the next event, failing unless it's of the given type.
+func (c *wsClient) expect(t *testing.T, eventType string) *wsTestEvent {
+	e := c.event(t)
+	if e == nil || e.Type != eventType {
+		t.Fatalf("Expected %s event, got %+v", eventType, e)
+	}
+	return e
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	s, b, srv := runBroker(t)
+	defer stopBroker(s, b, srv)
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	for _, test := range []struct {
+		name   string
+		header map[string]string
+		code   int
+	}{
+		{"same origin", map[string]string{"Origin": "http://" + addr}, http.StatusSwitchingProtocols},
+		{"no origin", nil, http.StatusSwitchingProtocols},
+		{"cross origin", map[string]string{"Origin": "http://evil.example.com"}, http.StatusForbidden},
+		{"wrong version", map[string]string{"Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{"no key", map[string]string{"Sec-WebSocket-Key": ""}, http.StatusBadRequest},
+		{"no upgrade", map[string]string{"Upgrade": ""}, http.StatusBadRequest},
+	} {
+		resp, conn, _ := handshake(t, addr, "/ws", test.header)
+		conn.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, resp.StatusCode)
+			continue
+		}
+		switch test.code {
+		case http.StatusSwitchingProtocols:
+			// the example of RFC 6455
+			if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+				t.Errorf("%s: unexpected accept hash [%s]", test.name, accept)
+			}
+		case http.StatusUpgradeRequired:
+			if version := resp.Header.Get("Sec-WebSocket-Version"); version != "13" {
+				t.Errorf("%s: expected the supported version, got [%s]", test.name, version)
+			}
+		}
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	ws, client := wsPipe()
+	defer client.Close()
+
+	// a fragmented message, with a ping in between, then a close
+	go func() {
+		client.Write(clientFrame(false, opText, []byte("hel"), true))
+		client.Write(clientFrame(true, opPing, []byte("are you there"), true))
+		client.Write(clientFrame(true, opContinuation, []byte("lo"), true))
+		client.Write(clientFrame(true, opClose, []byte{0x03, 0xe8, 'b', 'y', 'e'}, true))
+	}()
+	frames := make(chan []byte, 2)
+	go func() {
+		r := bufio.NewReader(client)
+		for {
+			op, payload, err := readServerFrame(r)
+			if err != nil {
+				close(frames)
+				return
+			}
+			frames <- append([]byte{byte(op)}, payload...)
+		}
+	}()
+
+	op, message, err := ws.readMessage()
+	if err != nil || op != opText || string(message) != "hello" {
+		t.Fatalf("Expected hello, got %d %q %v", op, message, err)
+	}
+	if pong := <-frames; pong[0] != opPong || string(pong[1:]) != "are you there" {
+		t.Errorf("Expected the ping to be answered, got %q", pong)
+	}
+	if _, _, err := ws.readMessage(); err != io.EOF {
+		t.Errorf("Expected io.EOF once closed, got %v", err)
+	}
+	if closing := <-frames; closing[0] != opClose || string(closing[1:]) != "\x03\xe8" {
+		t.Errorf("Expected the close code to be echoed, got %q", closing)
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	fragment := make([]byte, maxWebSocketMessage/2+1)
+	for _, test := range []struct {
+		name   string
+		frames [][]byte
+		err    error
+	}{
+		{"unmasked", [][]byte{clientFrame(true, opText, []byte("hi"), false)}, ERR_WEBSOCKET_PROTOCOL},
+		{"reserved bits", [][]byte{append([]byte{0x80 | 0x40 | opText}, clientFrame(true, opText, []byte("hi"), true)[1:]...)}, ERR_WEBSOCKET_PROTOCOL},
+		{"big control frame", [][]byte{clientFrame(true, opPing, make([]byte, 126), true)}, ERR_WEBSOCKET_PROTOCOL},
+		{"fragmented control frame", [][]byte{clientFrame(false, opPing, nil, true)}, ERR_WEBSOCKET_PROTOCOL},
+		{"unexpected continuation", [][]byte{clientFrame(true, opContinuation, []byte("hi"), true)}, ERR_WEBSOCKET_PROTOCOL},
+		{"interleaved message", [][]byte{clientFrame(false, opText, []byte("a"), true), clientFrame(true, opText, []byte("b"), true)}, ERR_WEBSOCKET_PROTOCOL},
+		{"unknown opcode", [][]byte{clientFrame(true, 0x3, nil, true)}, ERR_WEBSOCKET_PROTOCOL},
+		{"big frame", [][]byte{clientFrame(true, opText, make([]byte, maxWebSocketMessage+1), true)}, ERR_WEBSOCKET_TOO_BIG},
+		{"big message", [][]byte{clientFrame(false, opText, fragment, true), clientFrame(true, opContinuation, fragment, true)}, ERR_WEBSOCKET_TOO_BIG},
+	} {
+		ws, client := wsPipe()
+		go func(frames [][]byte) {
+			for _, frame := range frames {
+				if _, err := client.Write(frame); err != nil {
+					return
+				}
+			}
+		}(test.frames)
+
+		if _, _, err := ws.readMessage(); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+		client.Close()
+		ws.conn.Close()
+	}
+
+	// a message of exactly the limit is fine
+	ws, client := wsPipe()
+	defer client.Close()
+	go client.Write(clientFrame(true, opBinary, make([]byte, maxWebSocketMessage), true))
+	if op, message, err := ws.readMessage(); err != nil || op != opBinary || len(message) != maxWebSocketMessage {
+		t.Errorf("Expected a message of %d bytes, got %d %d %v", maxWebSocketMessage, op, len(message), err)
+	}
+}